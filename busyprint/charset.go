@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// charsetCandidates are tried, in order of preference, for sources that are
+// neither marked with a BOM nor valid UTF-8.
+var charsetCandidates = []struct {
+	name string
+	enc  encoding.Encoding
+}{
+	{"windows-1251", charmap.Windows1251},
+	{"koi8-r", charmap.KOI8R},
+	{"ibm866", charmap.CodePage866},
+	{"iso-8859-1", charmap.ISO8859_1},
+}
+
+// russianFrequency is the frequency of lowercase Russian letters in percent.
+var russianFrequency = map[rune]float64{
+	'о': 11, 'е': 8.5, 'а': 8, 'и': 7.4, 'н': 6.7, 'т': 6.3, 'с': 5.5, 'р': 4.7,
+	'в': 4.5, 'л': 4.4, 'к': 3.5, 'м': 3.2, 'д': 3, 'п': 2.8, 'у': 2.6, 'я': 2,
+	'ы': 1.9, 'ь': 1.7, 'г': 1.7, 'з': 1.6, 'б': 1.6, 'ч': 1.4, 'й': 1.2, 'х': 1,
+	'ж': 0.9, 'ш': 0.7, 'ю': 0.6, 'ц': 0.5, 'щ': 0.4, 'э': 0.3, 'ф': 0.3, 'ъ': 0.1,
+	'ё': 0.1,
+}
+
+// charsetScore rates how much text looks like a sensible decoding. Frequent
+// Russian letters score high, stray symbols and letters of one script glued
+// to letters of another score low.
+func charsetScore(text string) float64 {
+	var score float64
+	prevASCIILetter := false
+	for _, c := range text {
+		asciiLetter := c < utf8.RuneSelf && unicode.IsLetter(c)
+		switch {
+		case c < utf8.RuneSelf:
+		case unicode.Is(unicode.Cyrillic, c):
+			if f, ok := russianFrequency[unicode.ToLower(c)]; ok {
+				if unicode.IsLower(c) {
+					score += f
+				} else {
+					score += f / 2
+				}
+			} else {
+				score += 0.5
+			}
+			if prevASCIILetter {
+				score -= 3
+			}
+		case unicode.IsLetter(c) && c <= 0xff:
+			score += 1
+			if prevASCIILetter {
+				score += 2
+			}
+		default:
+			score -= 5
+		}
+		prevASCIILetter = asciiLetter
+	}
+	return score
+}
+
+// detectCharset guesses the charset of a source: a BOM wins, then valid UTF-8,
+// then whichever of the single-byte candidates gives the most plausible text.
+func detectCharset(data []byte) (string, encoding.Encoding) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8", xunicode.UTF8BOM
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return "utf-16le", xunicode.UTF16(xunicode.LittleEndian, xunicode.ExpectBOM)
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return "utf-16be", xunicode.UTF16(xunicode.BigEndian, xunicode.ExpectBOM)
+	case utf8.Valid(data):
+		return "utf-8", xunicode.UTF8
+	}
+
+	best, bestScore := 0, 0.0
+	for i, v := range charsetCandidates {
+		text, err := v.enc.NewDecoder().Bytes(data)
+		if err != nil {
+			continue
+		}
+		if score := charsetScore(string(text)); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return charsetCandidates[best].name, charsetCandidates[best].enc
+}
+
+// toUTF8 converts a source to UTF-8. The charset is detected if it is empty
+// or "auto". It returns the text and a description of the charset used.
+func toUTF8(data []byte, charset string) (string, string, error) {
+	var enc encoding.Encoding
+	description := charset
+	if charset == "" || strings.EqualFold(charset, "auto") {
+		charset, enc = detectCharset(data)
+		description = charset + " (detected)"
+	} else {
+		var err error
+		if enc, err = htmlindex.Get(charset); err != nil {
+			return "", "", fmt.Errorf("unknown charset %q: %w", charset, err)
+		}
+	}
+
+	text, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", "", fmt.Errorf("can't decode source as %s: %w", charset, err)
+	}
+	return strings.TrimPrefix(string(text), "\ufeff"), description, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"regexp"
+)
+
+// detectLimit bounds how much of a source is inspected.
+const detectLimit = 64 << 10
+
+var shebangRe = regexp.MustCompile(`^#!\s*\S*/(?:env\s+)?(python[\d.]*|bash|sh|perl|ruby|node)\b`)
+
+var shebangLanguages = map[string]string{
+	"bash": "bash",
+	"sh":   "bash",
+	"perl": "perl",
+	"ruby": "ruby",
+	"node": "javascript",
+}
+
+// languageRule is a piece of evidence for one or more languages. Weights are
+// roughly how many lines of typical code the match is worth.
+type languageRule struct {
+	re      *regexp.Regexp
+	weights map[string]float64
+}
+
+func rule(re string, weights map[string]float64) languageRule {
+	return languageRule{re: regexp.MustCompile(re), weights: weights}
+}
+
+// Language names are lexer names understood by both chroma and pygments.
+var languageRules = []languageRule{
+	rule(`(?m)^\s*#\s*include\s*<(?:iostream|bits/stdc\+\+\.h|vector|string|algorithm|map|set|queue|cstdio|cstring|cmath|cstdlib)>`, map[string]float64{"cpp": 3}),
+	rule(`(?m)^\s*#\s*include\s*<(?:stdio|stdlib|string|math|stdbool|stdint)\.h>`, map[string]float64{"c": 3, "cpp": 1}),
+	rule(`(?m)^\s*#\s*(?:include|define)\b`, map[string]float64{"c": 1, "cpp": 1}),
+	rule(`using\s+namespace\s+std\b`, map[string]float64{"cpp": 4}),
+	rule(`\bstd::`, map[string]float64{"cpp": 2}),
+	rule(`\b(?:cout|cerr)\s*<<|\bcin\s*>>`, map[string]float64{"cpp": 3}),
+	rule(`\btemplate\s*<`, map[string]float64{"cpp": 2}),
+	rule(`\b(?:printf|scanf)\s*\(`, map[string]float64{"c": 1}),
+
+	rule(`\bpublic\s+static\s+void\s+main\s*\(\s*(?:final\s+)?String`, map[string]float64{"java": 6}),
+	rule(`(?m)^\s*import\s+java\.`, map[string]float64{"java": 5}),
+	rule(`\bSystem\.(?:out|in)\b`, map[string]float64{"java": 3}),
+	rule(`(?m)^\s*package\s+[\w.]+\s*;`, map[string]float64{"java": 3}),
+
+	rule(`\bfun\s+main\s*\(`, map[string]float64{"kotlin": 5}),
+	rule(`(?m)^\s*import\s+kotlin\.`, map[string]float64{"kotlin": 5}),
+	rule(`\breadLine\(\)`, map[string]float64{"kotlin": 2}),
+	rule(`(?m)^\s*(?:val|var)\s+\w+\s*(?::\s*[\w<>?]+\s*)?=`, map[string]float64{"kotlin": 1, "scala": 1}),
+	rule(`\bobject\s+\w+\s+extends\s+App\b`, map[string]float64{"scala": 5}),
+	rule(`\bdef\s+main\s*\(\s*args\s*:\s*Array\[String\]`, map[string]float64{"scala": 6}),
+
+	rule(`(?m)^\s*using\s+System(?:\.[\w.]+)?\s*;`, map[string]float64{"csharp": 5}),
+	rule(`\bstatic\s+(?:void|int)\s+Main\s*\(`, map[string]float64{"csharp": 5}),
+	rule(`\bConsole\.(?:Write|Read)`, map[string]float64{"csharp": 3}),
+	rule(`(?m)^\s*namespace\s+[\w.]+`, map[string]float64{"csharp": 2, "cpp": 1}),
+
+	rule(`(?m)^\s*package\s+main\s*$`, map[string]float64{"go": 5}),
+	rule(`\bfunc\s+main\s*\(\s*\)`, map[string]float64{"go": 5}),
+	rule(`\bfmt\.(?:Print|Scan|Sprint|Fprint)`, map[string]float64{"go": 3}),
+
+	rule(`(?m)^\s*def\s+\w+\s*\(.*\)\s*(?:->\s*[^:]+)?:\s*(?:#.*)?$`, map[string]float64{"python": 3}),
+	rule(`(?m)^\s*(?:from\s+[\w.]+\s+)?import\s+[\w., ]+\s*$`, map[string]float64{"python": 1}),
+	rule(`(?m)^\s*(?:for|while|if|elif)\b.*:\s*(?:#.*)?$`, map[string]float64{"python": 1}),
+	rule(`\binput\(\)`, map[string]float64{"python": 2}),
+	rule(`\bif\s+__name__\s*==`, map[string]float64{"python": 5}),
+	rule(`\bprint\s*\(`, map[string]float64{"python": 1}),
+
+	rule(`(?im)^\s*program\s+\w+\s*;`, map[string]float64{"pascal": 5}),
+	rule(`(?im)^\s*uses\s+[\w, ]+;`, map[string]float64{"pascal": 4}),
+	rule(`(?im)^\s*var\s*$`, map[string]float64{"pascal": 2}),
+	rule(`(?i)\b(?:writeln|readln)\b`, map[string]float64{"pascal": 3}),
+	rule(`(?i)\bend\.`, map[string]float64{"pascal": 3}),
+	rule(`(?i)\bbegin\b`, map[string]float64{"pascal": 1}),
+
+	rule(`(?m)^\s*main\s*=\s*(?:do\b|interact\b)`, map[string]float64{"haskell": 5}),
+	rule(`(?m)^\s*import\s+(?:qualified\s+)?(?:Data|Control|System)\.`, map[string]float64{"haskell": 4}),
+	rule(`(?m)^\w+\s*::\s*\S`, map[string]float64{"haskell": 2}),
+
+	rule(`\bfn\s+main\s*\(\s*\)`, map[string]float64{"rust": 5}),
+	rule(`\blet\s+mut\b`, map[string]float64{"rust": 3}),
+	rule(`(?m)^\s*use\s+std::`, map[string]float64{"rust": 5}),
+	rule(`\bprintln!\s*\(`, map[string]float64{"rust": 4}),
+}
+
+// detectLanguage guesses the language of a source from its content. The
+// confidence is between 0 and 1: the share of evidence for the chosen
+// language, reduced when there is little evidence at all.
+func detectLanguage(src []byte) (string, float64) {
+	if len(src) > detectLimit {
+		src = src[:detectLimit]
+	}
+
+	if m := shebangRe.FindSubmatch(src); m != nil {
+		if lang, ok := shebangLanguages[string(m[1])]; ok {
+			return lang, 1
+		}
+		return "python", 1
+	}
+
+	scores := make(map[string]float64)
+	var total float64
+	for _, r := range languageRules {
+		if !r.re.Match(src) {
+			continue
+		}
+		for lang, w := range r.weights {
+			scores[lang] += w
+			total += w
+		}
+	}
+
+	var best string
+	for lang, v := range scores {
+		if best == "" || v > scores[best] || v == scores[best] && lang < best {
+			best = lang
+		}
+	}
+	if best == "" {
+		return "", 0
+	}
+	// The extra point keeps a single weak match from being taken for certain.
+	return best, scores[best] / (total + 1)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+// TestDetectLanguage runs the detector over the sources in testdata/detect,
+// named the way contestants name them, and checks which ones the default
+// DetectThreshold accepts.
+func TestDetectLanguage(t *testing.T) {
+	const threshold = 0.6
+	tests := []struct {
+		file      string
+		want      string
+		confident bool
+	}{
+		{"cpp/a", "cpp", true},
+		{"c/sol.txt", "c", true},
+		{"java/Main", "java", true},
+		{"python/a", "python", true},
+		{"shebang/Main", "python", true},
+		{"pascal/sol.txt", "pascal", true},
+		{"go/main", "go", true},
+		{"kotlin/Main", "kotlin", true},
+		{"csharp/a", "csharp", true},
+		{"haskell/a", "haskell", true},
+		{"rust/sol.txt", "rust", true},
+		{"scala/Main", "scala", true},
+		// A single weak hint: print( scores 1/(1+1) = 0.50.
+		{"weak/sol.txt", "python", false},
+		{"text/a", "", false},
+	}
+	for _, tt := range tests {
+		src, err := os.ReadFile(filepath.Join("testdata", "detect", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lang, confidence := detectLanguage(src)
+		if lang != tt.want || (confidence >= threshold) != tt.confident {
+			t.Errorf("%s: detected %q with confidence %.2f, want %q, confident %v", tt.file, lang, confidence, tt.want, tt.confident)
+		}
+	}
+}
+
+func TestSourceLanguage(t *testing.T) {
+	s := newTestServer(t)
+	read := func(name string) string {
+		src, err := os.ReadFile(filepath.Join("testdata", "detect", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(src)
+	}
+	tests := []struct {
+		filename, language, text string
+		want, reason             string
+	}{
+		{"a", "", read("cpp/a"), "cpp", "detected with confidence"},
+		{"sol.txt", "", read("c/sol.txt"), "c", "detected with confidence"},
+		{"Main", "", read("java/Main"), "java", "detected with confidence"},
+		{"sol.cpp", "", read("python/a"), "cpp", "from extension"},
+		{"sol.txt", "", read("weak/sol.txt"), "text", "from extension"},
+		{"a", "", read("weak/sol.txt"), "text", "unknown"},
+		{"a", "python", read("cpp/a"), "python", "requested"},
+		{"a", "py", read("cpp/a"), "python", "requested"},
+		{"a", "c++", read("java/Main"), "c++", "requested"},
+		{"a", "nosuchlanguage", read("cpp/a"), "cpp", `requested "nosuchlanguage" is unknown`},
+		{"a", "Python", read("cpp/a"), "cpp", `requested "Python" is unknown`},
+		{"sol.cpp", "../../etc/passwd", "", "cpp", `from extension, requested "../../etc/passwd" is unknown`},
+		{"a", "python -o x", read("text/a"), "text", "unknown, requested"},
+	}
+	for _, tt := range tests {
+		lang, reason := s.sourceLanguage(&tpb.PrintJob{Filename: tt.filename, Language: tt.language}, tt.text)
+		if lang != tt.want || !strings.HasPrefix(reason, tt.reason) && !strings.HasSuffix(reason, tt.reason) {
+			t.Errorf("%s requested as %q: got %q, %q, want %q, %q", tt.filename, tt.language, lang, reason, tt.want, tt.reason)
+		}
+	}
+}
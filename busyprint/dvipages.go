@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// DVI opcodes, see the DVI format description in dvitype.web.
+const (
+	dviBop      = 139
+	dviPre      = 247
+	dviPost     = 248
+	dviPostPost = 249
+	dviTrailer  = 223
+)
+
+// dviPageCount counts the pages of a DVI file by following the back pointers
+// of the bop commands from the postamble, and checks the count against the
+// total the postamble records, which is kept modulo 65536.
+func dviPageCount(data []byte) (int64, error) {
+	if len(data) < 2 || data[0] != dviPre {
+		return 0, errors.New("not a DVI file")
+	}
+
+	end := len(data)
+	for end > 0 && data[end-1] == dviTrailer {
+		end--
+	}
+	if len(data)-end < 4 || end < 6 || data[end-6] != dviPostPost {
+		return 0, errors.New("bad DVI trailer, the file may be truncated")
+	}
+	if id := data[end-1]; id != data[1] {
+		return 0, fmt.Errorf("DVI identification %d in the trailer differs from %d in the preamble", id, data[1])
+	}
+
+	post := int64(binary.BigEndian.Uint32(data[end-5:]))
+	if post+29 > int64(len(data)) || data[post] != dviPost {
+		return 0, errors.New("bad DVI postamble pointer")
+	}
+	total := int64(binary.BigEndian.Uint16(data[post+27:]))
+
+	var pages int64
+	for bop := int64(int32(binary.BigEndian.Uint32(data[post+1:]))); bop != -1; pages++ {
+		// A bop is followed by ten counters and the pointer to the previous bop.
+		if bop < 0 || bop+45 > post || data[bop] != dviBop {
+			return 0, fmt.Errorf("bad DVI page pointer %d", bop)
+		}
+		if pages > post/45 {
+			return 0, errors.New("DVI page pointers loop")
+		}
+		bop = int64(int32(binary.BigEndian.Uint32(data[bop+41:])))
+	}
+
+	if pages%65536 != total {
+		return 0, fmt.Errorf("DVI has %d pages but its postamble says %d", pages, total)
+	}
+	return pages, nil
+}
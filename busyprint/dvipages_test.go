@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// The files in testdata/dvi are written by hand to the format described in
+// dvitype.web: one.dvi and five.dvi have one and five pages, truncated.dvi is
+// the first half of five.dvi, and corrupt.dvi is five.dvi with the back
+// pointer of its fourth page off by three.
+
+func readDVI(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "dvi", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDVIPageCount(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want int64
+	}{
+		{"one.dvi", 1},
+		{"five.dvi", 5},
+	} {
+		got, err := dviPageCount(readDVI(t, tt.name))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %d pages, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+
+	five := readDVI(t, "five.dvi")
+	wrongTotal := append([]byte(nil), five...)
+	end := len(wrongTotal) - len(bytes.TrimRight(wrongTotal, "\xdf"))
+	post := binary.BigEndian.Uint32(wrongTotal[len(wrongTotal)-end-5:])
+	wrongTotal[post+28]++
+	tests := map[string][]byte{
+		"empty":            nil,
+		"PostScript":       []byte("%!PS-Adobe-3.0\n"),
+		"truncated":        readDVI(t, "truncated.dvi"),
+		"corrupt":          readDVI(t, "corrupt.dvi"),
+		"no trailer":       five[:len(five)-4],
+		"wrong page total": wrongTotal,
+	}
+	for name, data := range tests {
+		if n, err := dviPageCount(data); err == nil {
+			t.Errorf("%s: got %d pages, want an error", name, n)
+		}
+	}
+}
+
+// fakeCommands puts shell scripts named after the keys of scripts first in
+// PATH.
+func fakeCommands(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDvipsOutput(t *testing.T) {
+	const (
+		dvips       = `echo '%!PS' > "${3%.dvi}.ps"`
+		dviinfox    = `touch dviinfox.ran; echo "$2: 7 pages"`
+		dviinfoxBad = `echo "$2: no such file"; exit 1`
+	)
+	for _, tt := range []struct {
+		file         string
+		fallback     bool
+		dviinfox     string
+		wantPages    int64
+		wantError    bool
+		wantDviinfox bool
+	}{
+		{file: "one.dvi", fallback: true, dviinfox: dviinfox, wantPages: 1},
+		{file: "five.dvi", fallback: true, dviinfox: dviinfox, wantPages: 5},
+		{file: "truncated.dvi", fallback: true, dviinfox: dviinfox, wantPages: 7, wantDviinfox: true},
+		{file: "corrupt.dvi", fallback: true, dviinfox: dviinfox, wantPages: 7, wantDviinfox: true},
+		{file: "corrupt.dvi", dviinfox: dviinfox, wantError: true},
+		{file: "truncated.dvi", fallback: true, dviinfox: dviinfoxBad, wantError: true},
+	} {
+		fakeCommands(t, map[string]string{"dvips": dvips, "dviinfox": tt.dviinfox})
+		s := &server{bconfig: bconfig{DviinfoxFallback: tt.fallback}}
+		jobDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(jobDir, "job1.dvi"), readDVI(t, tt.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		data, pages, err := s.dvipsOutput(context.Background(), jobDir, "job1")
+		if (err != nil) != tt.wantError || pages != tt.wantPages || !tt.wantError && string(data) != "%!PS\n" {
+			t.Errorf("%s with fallback %v: got %q, %d pages, %v, want %d pages, error %v", tt.file, tt.fallback, data, pages, err, tt.wantPages, tt.wantError)
+		}
+		_, err = os.Stat(filepath.Join(jobDir, "dviinfox.ran"))
+		if ran := err == nil; ran != tt.wantDviinfox {
+			t.Errorf("%s with fallback %v: dviinfox ran %v, want %v", tt.file, tt.fallback, ran, tt.wantDviinfox)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/contester/printing3/tools"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// highlighter renders source code as a fancyvrb Verbatim environment with
+// line numbers, in the format of the pygments LaTeX formatter.
+type highlighter interface {
+	// Highlight renders the UTF-8 source file sourceName in jobDir using the
+	// named lexer, or plain text if there is no such lexer. It returns the
+	// name of the lexer used.
+	Highlight(ctx context.Context, jobDir, sourceName, lexer string) (string, string, error)
+	// Style returns the definitions the rendered code needs in the preamble.
+	Style(ctx context.Context) (string, error)
+}
+
+func newHighlighter(name string) (highlighter, error) {
+	switch name {
+	case "", "chroma":
+		return chromaHighlighter{style: styles.Get("bw")}, nil
+	case "pygments":
+		return pygmentsHighlighter{}, nil
+	}
+	return nil, fmt.Errorf("unknown highlighter %q", name)
+}
+
+// pygmentsHighlighter runs pygmentize.
+type pygmentsHighlighter struct{}
+
+func (pygmentsHighlighter) Highlight(ctx context.Context, jobDir, sourceName, lexer string) (string, string, error) {
+	outputName := strings.TrimSuffix(sourceName, filepath.Ext(sourceName)) + "-hl.tex"
+	run := func(lexer string) error {
+		args := []string{"-l", lexer, "-f", "latex", "-O", "linenos=1,tabsize=4,outencoding=utf8,encoding=utf8", "-o", outputName, sourceName}
+		cmd := exec.CommandContext(ctx, "pygmentize", args...)
+		cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = jobDir, os.Stdin, os.Stdout, os.Stderr
+		return tools.Traced(ctx, "pygmentize", runCmd(cmd), attribute.String("pygmentize.mode", "source"), attribute.String("highlight.lexer", lexer))
+	}
+
+	err := run(lexer)
+	if err != nil && lexer != "text" && ctx.Err() == nil {
+		// Most likely pygments has no such lexer.
+		tools.Log(ctx).Warnf("pygmentize failed with lexer %q, retrying as plain text: %v", lexer, err)
+		lexer = "text"
+		err = run(lexer)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	bs, err := os.ReadFile(filepath.Join(jobDir, outputName))
+	return string(bs), lexer, err
+}
+
+func (pygmentsHighlighter) Style(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, "pygmentize", "-f", "latex", "-S", "bw")
+	var styleBytes []byte
+	err := tools.Traced(ctx, "pygmentize", func(context.Context) (err error) {
+		styleBytes, err = cmd.Output()
+		return err
+	}, attribute.String("pygmentize.mode", "style"))
+	return string(styleBytes), err
+}
+
+// chromaAliases maps pygments lexer names chroma doesn't know.
+var chromaAliases = map[string]string{
+	"pascal": "objectpascal",
+	"delphi": "objectpascal",
+}
+
+// knownLexer reports whether chroma has a lexer for a language. Pygments
+// knows the same names, so this holds for either highlighter.
+func knownLexer(lang string) bool {
+	if _, ok := chromaAliases[lang]; ok {
+		return true
+	}
+	return lexers.Get(lang) != nil
+}
+
+// chromaHighlighter highlights in process with chroma lexers.
+type chromaHighlighter struct {
+	style *chroma.Style
+}
+
+// normalizeSource converts text to Unix line endings and expands tabs, as
+// pygments does.
+func normalizeSource(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.Trim(text, "\n") + "\n"
+
+	lines := strings.Split(text, "\n")
+	for i, v := range lines {
+		lines[i] = expandTabs(v, 4)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func expandTabs(s string, size int) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	var b strings.Builder
+	col := 0
+	for _, c := range s {
+		if c == '\t' {
+			n := size - col%size
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(c)
+		col++
+	}
+	return b.String()
+}
+
+var texEscapes = strings.NewReplacer(
+	`\`, `\PYZbs{}`,
+	`{`, `\PYZob{}`,
+	`}`, `\PYZcb{}`,
+	`^`, `\PYZca{}`,
+	`_`, `\PYZus{}`,
+	`&`, `\PYZam{}`,
+	`<`, `\PYZlt{}`,
+	`>`, `\PYZgt{}`,
+	`#`, `\PYZsh{}`,
+	`%`, `\PYZpc{}`,
+	`$`, `\PYZdl{}`,
+	`-`, `\PYZhy{}`,
+	`'`, `\PYZsq{}`,
+	`"`, `\PYZdq{}`,
+	`~`, `\PYZti{}`,
+)
+
+// tokenClass returns the pygments short name of the token type, or of its
+// closest ancestor that has one.
+func tokenClass(t chroma.TokenType) string {
+	for ; t > 0; t = t.Parent() {
+		if name, ok := chroma.StandardTypes[t]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func (h chromaHighlighter) Highlight(ctx context.Context, jobDir, sourceName, lexer string) (string, string, error) {
+	data, err := os.ReadFile(filepath.Join(jobDir, sourceName))
+	if err != nil {
+		return "", "", err
+	}
+	text := normalizeSource(string(data))
+
+	l := lexers.Get(lexer)
+	if alias, ok := chromaAliases[lexer]; l == nil && ok {
+		l = lexers.Get(alias)
+	}
+	if l == nil {
+		l = lexers.Fallback
+	}
+	lexer = l.Config().Name
+
+	var result bytes.Buffer
+	err = tools.Traced(ctx, "highlight", func(context.Context) error {
+		it, err := chroma.Coalesce(l).Tokenise(nil, text)
+		if err != nil {
+			return err
+		}
+
+		result.WriteString("\\begin{Verbatim}[commandchars=\\\\\\{\\},numbers=left,firstnumber=1,stepnumber=1]\n")
+		for tok := it(); tok != chroma.EOF; tok = it() {
+			class := tokenClass(tok.Type)
+			lines := strings.Split(texEscapes.Replace(tok.Value), "\n")
+			for i, v := range lines {
+				if i > 0 {
+					result.WriteByte('\n')
+				}
+				switch {
+				case v == "":
+				case class == "":
+					result.WriteString(v)
+				default:
+					fmt.Fprintf(&result, "\\PY{%s}{%s}", class, v)
+				}
+			}
+		}
+		result.WriteString("\\end{Verbatim}\n")
+		return nil
+	}, attribute.String("highlight.lexer", lexer))
+	return result.String(), lexer, err
+}
+
+const styleHeader = `\makeatletter
+\def\PY@reset{\let\PY@it=\relax \let\PY@bf=\relax%
+    \let\PY@ul=\relax \let\PY@tc=\relax%
+    \let\PY@bc=\relax \let\PY@ff=\relax}
+\def\PY@tok#1{\csname PY@tok@#1\endcsname}
+\def\PY@toks#1+{\ifx\relax#1\empty\else%
+    \PY@tok{#1}\expandafter\PY@toks\fi}
+\def\PY@do#1{\PY@bc{\PY@tc{\PY@ul{%
+    \PY@it{\PY@bf{\PY@ff{#1}}}}}}}
+\def\PY#1#2{\PY@reset\PY@toks#1+\relax+\PY@do{#2}}
+
+`
+
+const styleFooter = `
+\def\PYZbs{\char` + "`" + `\\}
+\def\PYZus{\char` + "`" + `\_}
+\def\PYZob{\char` + "`" + `\{}
+\def\PYZcb{\char` + "`" + `\}}
+\def\PYZca{\char` + "`" + `\^}
+\def\PYZam{\char` + "`" + `\&}
+\def\PYZlt{\char` + "`" + `\<}
+\def\PYZgt{\char` + "`" + `\>}
+\def\PYZsh{\char` + "`" + `\#}
+\def\PYZpc{\char` + "`" + `\%}
+\def\PYZdl{\char` + "`" + `\$}
+\def\PYZhy{\char` + "`" + `\-}
+\def\PYZsq{\char` + "`" + `\'}
+\def\PYZdq{\char` + "`" + `\"}
+\def\PYZti{\char` + "`" + `\~}
+\makeatother
+`
+
+// Style defines the pygments macros, with a definition for each token class
+// the style makes bold, italic or underlined. Colours are left out, the
+// output is printed in black and white.
+func (h chromaHighlighter) Style(context.Context) (string, error) {
+	defs := make(map[string]string)
+	for t, class := range chroma.StandardTypes {
+		if t <= 0 || class == "" {
+			continue
+		}
+		e := h.style.Get(t)
+		var def string
+		if e.Bold == chroma.Yes {
+			def += `\let\PY@bf=\textbf`
+		}
+		if e.Italic == chroma.Yes {
+			def += `\let\PY@it=\textit`
+		}
+		if e.Underline == chroma.Yes {
+			def += `\let\PY@ul=\underline`
+		}
+		if def != "" {
+			defs[class] = def
+		}
+	}
+
+	classes := make([]string, 0, len(defs))
+	for k := range defs {
+		classes = append(classes, k)
+	}
+	sort.Strings(classes)
+
+	var result strings.Builder
+	result.WriteString(styleHeader)
+	for _, v := range classes {
+		fmt.Fprintf(&result, "\\@namedef{PY@tok@%s}{%s}\n", v, defs[v])
+	}
+	result.WriteString(styleFooter)
+	return result.String(), nil
+}
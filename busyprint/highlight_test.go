@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with the file testdata/highlight/name, or writes it
+// there if -update is set.
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "highlight", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s, run with -update and check the diff:\n%s", path, got)
+	}
+}
+
+var pyMacro = regexp.MustCompile(`\\PY\{([^}]*)\}|\\(PYZ[a-z]+)\{\}`)
+
+// TestChromaHighlight renders the sources in testdata/highlight. The C source
+// has CRLF line endings, tabs and every character that needs escaping.
+func TestChromaHighlight(t *testing.T) {
+	h := chromaHighlighter{style: styles.Get("bw")}
+	style, err := h.Style(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "style.tex", style)
+	if !strings.Contains(style, `\def\PY#1#2{`) {
+		t.Errorf("style doesn't define \\PY")
+	}
+
+	for _, tt := range []struct {
+		source, lexer, wantLexer, golden string
+	}{
+		{"c.c", "c", "C", "c.tex"},
+		{"plain.txt", "no such lexer", "fallback", "plain.tex"},
+	} {
+		t.Run(tt.source, func(t *testing.T) {
+			got, lexer, err := h.Highlight(context.Background(), filepath.Join("testdata", "highlight"), tt.source, tt.lexer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lexer != tt.wantLexer {
+				t.Errorf("lexer = %q, want %q", lexer, tt.wantLexer)
+			}
+			golden(t, tt.golden, got)
+
+			if !strings.HasPrefix(got, `\begin{Verbatim}[commandchars=\\\{\},numbers=left,firstnumber=1,stepnumber=1]`+"\n") ||
+				!strings.HasSuffix(got, "\\end{Verbatim}\n") {
+				t.Errorf("output is not a numbered Verbatim environment with commandchars")
+			}
+			if strings.ContainsAny(got, "\t\r") {
+				t.Errorf("output has tabs or carriage returns")
+			}
+			// Every macro used must be defined by Style, or the template fails
+			// to compile.
+			for _, m := range pyMacro.FindAllStringSubmatch(got, -1) {
+				if m[1] != "" {
+					for _, class := range strings.Split(m[1], "+") {
+						if class == "" {
+							t.Errorf("empty token class in %q", m[0])
+						}
+					}
+				} else if !strings.Contains(style, `\def\`+m[2]+`{`) {
+					t.Errorf("style doesn't define \\%s", m[2])
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeSource(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"a\rb", "a\nb\n"},
+		{"\n\na\n\n\n", "a\n"},
+		{"\tx", "    x\n"},
+		{"ab\tx\ty", "ab  x   y\n"},
+		{"абв\tx", "абв x\n"},
+	} {
+		if got := normalizeSource(tt.in); got != tt.want {
+			t.Errorf("normalizeSource(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
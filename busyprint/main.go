@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"os"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/contester/printing3/tools"
 	"github.com/coreos/go-systemd/v22/daemon"
-	"github.com/go-stomp/stomp"
 	"github.com/kelseyhightower/envconfig"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
 	"stingr.net/go/systemdutil"
 
@@ -19,62 +24,95 @@ import (
 type server struct {
 	bconfig
 
-	languageMap map[string]string
+	languageMap    map[string]string
+	printerEngines map[string]string
+	jsonQueues     map[string]bool
+	highlighter    highlighter
+	templates      *templateSet
 }
 
-func (s *server) processPrintJob(ctx context.Context, msg *stomp.Message) error {
+func (s *server) sendAndAck(msg *tools.Message, dest string, data proto.Message) error {
+	return tools.SendAndAck(msg, dest, data, tools.AsJSON(s.jsonQueues[dest]))
+}
+
+func (s *server) processPrintJob(ctx context.Context, msg *tools.Message) error {
 	var job tpb.PrintJob
 
-	err := proto.Unmarshal(msg.Body, &job)
+	err := tools.Unmarshal(msg, &job)
 	if err != nil {
-		log.Errorf("error parsing print job %+v", msg)
-		return tools.MaybeAck(msg)
-	}
-
-	bpb := tpb.TexJob{
-		Printer: job.GetPrinter(),
-		JobId:   job.GetJobId(),
+		return fmt.Errorf("error parsing print job: %w", err)
 	}
+	ctx = tools.WithLogFields(ctx, log.Fields{"job_id": job.GetJobId(), "printer": job.GetPrinter()})
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("job.id", job.GetJobId()), attribute.String("job.printer", job.GetPrinter()))
+	tools.Log(ctx).Infof("rendering source %q", job.GetFilename())
 
-	bpb.Data, err = s.processSource(ctx, &job)
+	bpb, err := s.processSource(ctx, &job, s.engineFor(job.GetPrinter()))
 	if err != nil {
-		return tools.SendAndAck(msg, s.FailureQueue, &tpb.PrintJobReport{
+		if ctx.Err() != nil {
+			// Shutting down: leave the job to be redelivered.
+			return ctx.Err()
+		}
+		tools.Log(ctx).Errorf("job failed: %v", err)
+		msg.MarkFailed()
+		return s.sendAndAck(msg, s.FailureQueue, &tpb.PrintJobReport{
 			JobExpandedId:    job.GetJobId(),
 			ErrorMessage:     err.Error(),
 			TimestampSeconds: time.Now().Unix(),
 		})
 	}
 
-	return tools.SendAndAck(msg, s.TexQueue, &bpb)
+	bpb.Printer, bpb.JobId = job.GetPrinter(), job.GetJobId()
+	return s.sendAndAck(msg, s.TexQueue, bpb)
 }
 
-func (s *server) processTexJob(ctx context.Context, msg *stomp.Message) error {
+func (s *server) processTexJob(ctx context.Context, msg *tools.Message) error {
 	var job tpb.TexJob
 
-	err := proto.Unmarshal(msg.Body, &job)
+	err := tools.Unmarshal(msg, &job)
 	if err != nil {
-		log.Errorf("error parsing tex job %+v", msg)
-		return tools.MaybeAck(msg)
+		return fmt.Errorf("error parsing tex job: %w", err)
 	}
+	ctx = tools.WithLogFields(ctx, log.Fields{"job_id": job.GetJobId(), "printer": job.GetPrinter()})
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("job.id", job.GetJobId()), attribute.String("job.printer", job.GetPrinter()))
+	tools.Log(ctx).Infof("running latex")
 
 	bpb := tpb.BinaryJob{
-		Printer: job.GetPrinter(),
-		JobId:   job.GetJobId(),
+		Printer:  job.GetPrinter(),
+		JobId:    job.GetJobId(),
+		Fallback: job.GetFallback(),
+		Language: job.GetLanguage(),
+		Charset:  job.GetCharset(),
 	}
 
-	bpb.Data, bpb.Pages, err = s.processTex(ctx, bpb.JobId, job.GetData())
+	bpb.Data, bpb.Pages, bpb.MimeType, err = s.processTex(ctx, bpb.JobId, bpb.Printer, job.GetEngine(), job.GetData())
 	if err != nil {
-		return tools.SendAndAck(msg, s.FailureQueue, &tpb.PrintJobReport{
+		if ctx.Err() != nil {
+			// Shutting down: leave the job to be redelivered.
+			return ctx.Err()
+		}
+		tools.Log(ctx).Errorf("job failed: %v", err)
+		msg.MarkFailed()
+		return s.sendAndAck(msg, s.FailureQueue, &tpb.PrintJobReport{
 			JobExpandedId:    job.GetJobId(),
 			ErrorMessage:     err.Error(),
+			Fallback:         job.GetFallback(),
+			Language:         job.GetLanguage(),
+			Charset:          job.GetCharset(),
 			TimestampSeconds: time.Now().Unix(),
 		})
 	}
 
-	return tools.SendAndAck(msg, s.BinaryQueue, &bpb)
+	// Counted once sent, as a failed send is retried.
+	if err := s.sendAndAck(msg, s.BinaryQueue, &bpb); err != nil {
+		return err
+	}
+	tools.CountPages(bpb.GetPrinter(), bpb.GetPages())
+	return nil
 }
 
 type bconfig struct {
+	// StompDSN is the broker, see tools.ParseStompDSN, or tools.MemDSN to pass
+	// messages between the stages in memory.
 	StompDSN string
 
 	SourceDir string
@@ -85,10 +123,84 @@ type bconfig struct {
 	TexQueue     string
 	BinaryQueue  string
 
+	DeadLetterQueue string
+	MaxAttempts     int `default:"5"`
+	// RetryDelay doubles for every failed attempt up to MaxRetryDelay. The
+	// broker waits it out if it schedules delivery by RetryDelayHeader, such
+	// as AMQ_SCHEDULED_DELAY; otherwise a worker waits, up to MaxRetryWait.
+	RetryDelay       time.Duration `default:"1s"`
+	MaxRetryDelay    time.Duration `default:"1m"`
+	RetryDelayHeader string
+	MaxRetryWait     time.Duration `default:"5s"`
+
+	SourceWorkers int `default:"1"`
+	TexWorkers    int `default:"1"`
+
+	DrainTimeout time.Duration `default:"30s"`
+
+	// TraceExporter is otlp, stdout or empty for no tracing.
+	TraceExporter string
+	MetricsAddr   string
+
+	// BlobStore receives payloads of BlobThreshold bytes and more instead of
+	// the broker, see tools.OpenBlobStore.
+	BlobStore     string
+	BlobThreshold int `default:"262144"`
+
+	// Compression rules for sent messages, see tools.ParseCompression.
+	Compression []string
+	// MaxDecodedSize bounds received bodies after decompression, see
+	// tools.Compression.
+	MaxDecodedSize int `default:"67108864"`
+	// JSONQueues get messages encoded as JSON instead of binary protobuf.
+	JSONQueues []string
+
+	// Each stage signs what it sends with its signing key and, if it has any
+	// verify keys, dead-letters messages not signed with one of them. See
+	// tools.ParseSigningKey for the format.
+	SourceSigningKey string
+	SourceVerifyKeys []string
+	TexSigningKey    string
+	TexVerifyKeys    []string
+
 	Languages []string
+	// DetectThreshold is the confidence needed to use the language detected
+	// from the content of a file without a known extension.
+	DetectThreshold float64 `default:"0.6"`
+
+	// Highlighter is chroma, built in, or pygments, which runs pygmentize.
+	Highlighter string `default:"chroma"`
+
+	// TemplateDir holds document templates selected by contest and area, see
+	// templateSet. They are reloaded on SIGHUP and when the directory changes.
+	TemplateDir string
+
+	// TexEngine is latex, which makes PostScript through DVI, or pdflatex,
+	// xelatex or lualatex, which make PDF. PrinterEngines entries of the form
+	// printer=engine override it for some printers.
+	TexEngine      string `default:"latex"`
+	PrinterEngines []string
+	// DviinfoxFallback runs dviinfox to count the pages of a DVI file that
+	// busyprint can't read itself.
+	DviinfoxFallback bool
+
+	// Jobs with characters the default template fonts lack are rendered with
+	// the Unicode template and typeset with UnicodeEngine, xelatex or
+	// lualatex, which makes PDF even for printers set to latex. The template
+	// sets them in MonoFont, or the first of FallbackFonts that has them.
+	UnicodeEngine string   `default:"xelatex"`
+	MonoFont      string   `default:"DejaVu Sans Mono"`
+	FallbackFonts []string `default:"Noto Sans Mono CJK SC,Noto Sans Symbols2,DejaVu Sans"`
 }
 
+var (
+	renderFile   = flag.String("render", "", "render this source file to LaTeX on stdout and exit")
+	renderJob    = flag.String("job", "", "with -render, PrintJob JSON to take the team, contest, area and other fields from")
+	templateFile = flag.String("template", "", "with -render, use this template file instead of the template directory")
+)
+
 func main() {
+	flag.Parse()
 	systemdutil.Init()
 
 	var srv server
@@ -107,31 +219,121 @@ func main() {
 		}
 	}
 
-	sconf, err := tools.ParseStompDSN(srv.bconfig.StompDSN)
-	if err != nil {
+	srv.printerEngines = make(map[string]string)
+	for _, v := range srv.PrinterEngines {
+		s := strings.SplitN(v, "=", 2)
+		if len(s) != 2 {
+			log.Fatalf("printer engine must be printer=engine, got %q", v)
+		}
+		if _, ok := texEngines[s[1]]; !ok {
+			log.Fatalf("unknown TeX engine %q for printer %q", s[1], s[0])
+		}
+		srv.printerEngines[s[0]] = s[1]
+	}
+	if _, ok := texEngines[srv.TexEngine]; !ok {
+		log.Fatalf("unknown TeX engine %q", srv.TexEngine)
+	}
+	if !unicodeEngines[srv.UnicodeEngine] {
+		log.Fatalf("unicode engine must be xelatex or lualatex, got %q", srv.UnicodeEngine)
+	}
+
+	var err error
+	if srv.highlighter, err = newHighlighter(srv.Highlighter); err != nil {
 		log.Fatal(err)
 	}
 
-	ctx := context.Background()
-	sconn, err := tools.DialStomp(ctx, sconf)
+	if *templateFile != "" {
+		t, err := parseTemplateFile(*templateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := "default"
+		if strings.HasSuffix(strings.TrimSuffix(*templateFile, templateExt), unicodeSuffix) {
+			name += unicodeSuffix
+		}
+		srv.templates = &templateSet{templates: map[string]*template.Template{name: t}}
+	} else {
+		srv.templates = newTemplateSet(srv.TemplateDir)
+	}
+
+	if *renderFile != "" {
+		if err := srv.render(context.Background(), os.Stdout, *renderFile, *renderJob); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	srv.jsonQueues = make(map[string]bool)
+	for _, v := range srv.JSONQueues {
+		srv.jsonQueues[v] = true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownTracing, err := tools.InitTracing(ctx, "busyprint", srv.TraceExporter)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer shutdownTracing(context.Background())
 
-	defer sconn.MustDisconnect()
+	tools.ServeMetrics(srv.MetricsAddr)
+	go srv.templates.watch(ctx)
 
-	sourceSub, err := tools.SubscribeAndProcess(ctx, sconn, srv.SourceQueue, srv.processPrintJob)
+	compression, err := tools.ParseCompression(srv.Compression)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer sourceSub.Unsubscribe()
+	compression.MaxDecodedSize = srv.MaxDecodedSize
 
-	texSub, err := tools.SubscribeAndProcess(ctx, sconn, srv.TexQueue, srv.processTexJob)
+	tr, err := tools.OpenTransport(srv.StompDSN, srv.DrainTimeout, compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if st, ok := tr.(*tools.StompTransport); ok {
+		st.OnStateChange = func(state tools.ConnState) {
+			switch state {
+			case tools.StateConnected:
+				daemon.SdNotify(false, daemon.SdNotifyReady+"\nSTATUS=connected to "+st.Endpoint())
+			case tools.StateDisconnected:
+				daemon.SdNotify(false, "STATUS=waiting for broker")
+			}
+		}
+	} else {
+		daemon.SdNotify(false, daemon.SdNotifyReady+"\nSTATUS=running without a broker")
+	}
+	blobs, err := tools.OpenBlobStore(srv.BlobStore)
 	if err != nil {
-		log.Fatal()
+		log.Fatal(err)
 	}
-	defer texSub.Unsubscribe()
-	daemon.SdNotify(false, daemon.SdNotifyReady)
-	defer daemon.SdNotify(false, daemon.SdNotifyStopping)
+	claims := tools.ClaimCheck{Store: blobs, Threshold: srv.BlobThreshold}
+	retry := tools.RetryPolicy{
+		MaxAttempts:     srv.MaxAttempts,
+		DeadLetterQueue: srv.DeadLetterQueue,
+		RetryDelay:      srv.RetryDelay,
+		MaxRetryDelay:   srv.MaxRetryDelay,
+		DelayHeader:     srv.RetryDelayHeader,
+		MaxRetryWait:    srv.MaxRetryWait,
+	}
+	sourceSigning, err := tools.NewSigning(srv.SourceSigningKey, srv.SourceVerifyKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	texSigning, err := tools.NewSigning(srv.TexSigningKey, srv.TexVerifyKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tr.Subscribe(srv.SourceQueue, srv.SourceWorkers, tools.WithStage("source", retry.Wrap(sourceSigning.Wrap(claims.Wrap(srv.processPrintJob)))))
+	tr.Subscribe(srv.TexQueue, srv.TexWorkers, tools.WithStage("tex", retry.Wrap(texSigning.Wrap(claims.Wrap(srv.processTexJob)))))
+
+	done := make(chan struct{})
+	go func() {
+		tr.Run(ctx)
+		close(done)
+	}()
+
 	systemdutil.WaitSigint()
+	daemon.SdNotify(false, daemon.SdNotifyStopping)
+	cancel()
+	<-done
 }
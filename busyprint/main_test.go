@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contester/printing3/tools"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+// pagesCounted returns the pages_total metric for printer.
+func pagesCounted(t *testing.T, printer string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "printing_pages_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "printer" && l.GetValue() == printer {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// TestProcessTexJobPages checks that pages are counted once the binary job is
+// sent, and not for a send that fails and is retried.
+func TestProcessTexJobPages(t *testing.T) {
+	pdf, err := filepath.Abs(filepath.Join("testdata", "pdf", "objstm.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCommands(t, map[string]string{"pdflatex": `cp "` + pdf + `" "${2%.tex}.pdf"`})
+
+	for _, tt := range []struct {
+		printer   string
+		sendFails bool
+		want      float64
+		wantSent  int
+	}{
+		{"pages-sent", false, 3, 1},
+		{"pages-not-sent", true, 0, 0},
+	} {
+		s := newTestServer(t)
+		s.TexDir, s.TexQueue, s.BinaryQueue = t.TempDir(), "tex", "binary"
+		tr := tools.NewMemTransport()
+		tr.ErrorDelay = time.Millisecond
+		errs := make(chan error, 1)
+		tr.Subscribe(s.TexQueue, 1, func(ctx context.Context, msg *tools.Message) error {
+			if tt.sendFails {
+				// Acknowledged already, so the send is refused.
+				tools.MaybeAck(msg)
+			}
+			err := s.processTexJob(ctx, msg)
+			errs <- err
+			return err
+		})
+		body, err := proto.Marshal(&tpb.TexJob{JobId: "job1", Printer: tt.printer, Engine: "pdflatex", Data: []byte(`\relax`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Publish(s.TexQueue, &tools.Message{ContentType: tools.ContentTypeProtobuf, Body: body})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			tr.Run(ctx)
+			close(done)
+		}()
+		select {
+		case err = <-errs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("job not processed")
+		}
+		cancel()
+		<-done
+
+		if tt.sendFails && (err == nil || !strings.Contains(err.Error(), "already acknowledged")) || !tt.sendFails && err != nil {
+			t.Errorf("%s: processTexJob returned %v, want a failed send %v", tt.printer, err, tt.sendFails)
+		}
+		if got := pagesCounted(t, tt.printer); got != tt.want {
+			t.Errorf("%s: counted %v pages, want %v", tt.printer, got, tt.want)
+		}
+		if n := tr.Len(s.BinaryQueue); n != tt.wantSent {
+			t.Errorf("%s: %d binary jobs sent, want %d", tt.printer, n, tt.wantSent)
+		}
+	}
+}
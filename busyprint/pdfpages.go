@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+var (
+	pdfObjRe      = regexp.MustCompile(`(?s)(\d+)\s+\d+\s+obj\b(.*?)\bendobj\b`)
+	pdfObjStmRe   = regexp.MustCompile(`^\s*<<([^<>]*/Type\s*/ObjStm[^<>]*)>>\s*stream\r?\n`)
+	pdfObjStmNRe  = regexp.MustCompile(`/N\s+(\d+)`)
+	pdfFirstRe    = regexp.MustCompile(`/First\s+(\d+)`)
+	pdfRootRe     = regexp.MustCompile(`/Root\s+(\d+)\s+\d+\s+R\b`)
+	pdfPagesRefRe = regexp.MustCompile(`/Pages\s+(\d+)\s+\d+\s+R\b`)
+	pdfCountRe    = regexp.MustCompile(`/Count\s+(\d+)(\s+\d+\s+R\b)?`)
+)
+
+// pdfPageCount reads the page count of a PDF from the /Count of its page tree.
+// It finds objects by scanning for them rather than through the xref table,
+// which is enough for TeX output: the page tree may be in compressed object
+// streams, as pdfTeX and xdvipdfmx write it, and a later definition of an
+// object, as from an incremental update, replaces an earlier one.
+func pdfPageCount(data []byte) (int64, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return 0, errors.New("not a PDF file")
+	}
+	objects, err := pdfObjects(data)
+	if err != nil {
+		return 0, err
+	}
+
+	// The trailer or the xref stream of the last update names the catalog.
+	roots := pdfRootRe.FindAllSubmatch(data, -1)
+	if len(roots) == 0 {
+		return 0, errors.New("no document catalog in PDF")
+	}
+	catalog, ok := objects[string(roots[len(roots)-1][1])]
+	if !ok {
+		return 0, errors.New("document catalog not found in PDF")
+	}
+	m := pdfPagesRefRe.FindSubmatch(catalog)
+	if m == nil {
+		return 0, errors.New("no page tree in PDF")
+	}
+	tree, ok := objects[string(m[1])]
+	if !ok {
+		return 0, errors.New("page tree not found in PDF")
+	}
+	m = pdfCountRe.FindSubmatch(tree)
+	if m == nil {
+		return 0, errors.New("no page count in PDF")
+	}
+	count := m[1]
+	if len(m[2]) > 0 {
+		// An indirect count, the object holds the number.
+		count = bytes.TrimSpace(objects[string(m[1])])
+	}
+	pages, err := strconv.ParseInt(string(count), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad page count %q in PDF", count)
+	}
+	if pages == 0 {
+		return 0, errors.New("no pages found in PDF")
+	}
+	return pages, nil
+}
+
+// pdfObjects returns the bodies of the objects of a PDF by object number, in
+// file order, with the objects of Flate-compressed object streams in place of
+// the stream.
+func pdfObjects(data []byte) (map[string][]byte, error) {
+	objects := make(map[string][]byte)
+	for _, m := range pdfObjRe.FindAllSubmatch(data, -1) {
+		objects[string(m[1])] = m[2]
+		loc := pdfObjStmRe.FindSubmatchIndex(m[2])
+		if loc == nil {
+			continue
+		}
+		dict := m[2][loc[2]:loc[3]]
+		if !bytes.Contains(dict, []byte("/FlateDecode")) {
+			continue
+		}
+		// The reader stops at the end of the zlib stream, so /Length, which
+		// may be an indirect object, isn't needed.
+		r, err := zlib.NewReader(bytes.NewReader(m[2][loc[1]:]))
+		if err != nil {
+			return nil, err
+		}
+		stream, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := readObjStm(dict, stream, objects); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// readObjStm adds the objects of a decompressed object stream to objects.
+// The stream starts with pairs of object numbers and offsets from /First.
+func readObjStm(dict, stream []byte, objects map[string][]byte) error {
+	n, first := pdfObjStmNRe.FindSubmatch(dict), pdfFirstRe.FindSubmatch(dict)
+	if n == nil || first == nil {
+		return errors.New("object stream without /N or /First")
+	}
+	count, _ := strconv.Atoi(string(n[1]))
+	start, _ := strconv.Atoi(string(first[1]))
+	if start > len(stream) {
+		return errors.New("object stream shorter than its header")
+	}
+	header := bytes.Fields(stream[:start])
+	if len(header) < 2*count {
+		return errors.New("object stream header is short")
+	}
+	for i := 0; i < count; i++ {
+		begin, err := strconv.Atoi(string(header[2*i+1]))
+		end := len(stream) - start
+		if i+1 < count {
+			end, _ = strconv.Atoi(string(header[2*i+3]))
+		}
+		if err != nil || begin < 0 || begin > end || start+end > len(stream) {
+			return errors.New("bad offset in object stream")
+		}
+		objects[string(header[2*i])] = stream[start+begin : start+end]
+	}
+	return nil
+}
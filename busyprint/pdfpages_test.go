@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readPDF(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "pdf", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPDFPageCount(t *testing.T) {
+	// The files are written by testdata/pdf/gen.go in the layouts of pdfTeX
+	// and xdvipdfmx. update.pdf drops a page in an incremental update, and
+	// still has 3 page objects.
+	objstm := readPDF(t, "objstm.pdf")
+	indirect := bytes.Replace(objstm, []byte("/Count 3/"), []byte("/Count 9 0 R/"), 1)
+	indirect = append(indirect, "9 0 obj\n3\nendobj\n"...)
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want int64
+	}{
+		{"pdftex.pdf", readPDF(t, "pdftex.pdf"), 8},
+		{"objstm.pdf", objstm, 3},
+		{"update.pdf", readPDF(t, "update.pdf"), 2},
+		{"indirect count", indirect, 3},
+	} {
+		got, err := pdfPageCount(tt.data)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %d pages, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestPDFPageCountErrors(t *testing.T) {
+	pdftex := readPDF(t, "pdftex.pdf")
+	objstm := readPDF(t, "objstm.pdf")
+	// Cut inside the first compressed object stream.
+	cut := bytes.Index(objstm, []byte("stream\n")) + len("stream\n") + 10
+	tests := map[string][]byte{
+		"empty":                 nil,
+		"PostScript":            []byte("%!PS-Adobe-3.0\n%%Pages: 1\n"),
+		"header only":           []byte("%PDF-1.5\n%%EOF\n"),
+		"truncated stream":      objstm[:cut],
+		"corrupt stream":        append(append(objstm[:cut:cut], "garbage"...), objstm[cut+7:]...),
+		"truncated pdfTeX file": pdftex[:bytes.Index(pdftex, []byte("/Type/ObjStm"))+100],
+		"no catalog":            bytes.ReplaceAll(objstm, []byte("/Root"), []byte("/Info")),
+		"missing page tree":     bytes.Replace(objstm, []byte("/Pages 2 0 R"), []byte("/Pages 99 0 R"), 1),
+		"no count":              bytes.Replace(objstm, []byte("/Count 3"), []byte("/Cnt 3"), 1),
+		"zero pages":            bytes.Replace(objstm, []byte("/Count 3"), []byte("/Count 0"), 1),
+	}
+	for name, data := range tests {
+		if n, err := pdfPageCount(data); err == nil {
+			t.Errorf("%s: got %d pages, want an error", name, n)
+		}
+	}
+}
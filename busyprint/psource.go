@@ -5,12 +5,17 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"text/template"
 
+	"github.com/contester/printing3/tools"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	tpb "github.com/contester/printing3/tickets"
+	log "github.com/sirupsen/logrus"
 )
 
 const documentTemplateString = `\documentclass[12pt,a4paper,oneside]{article}
@@ -55,6 +60,70 @@ File name & {{.GetFilename}} \\
 \hline
 Contest & ({{.GetContest.GetId}}) {{.GetContest.GetName}} \\
 \hline
+Encoding & {{.Encoding}} \\
+\hline
+Pages & \pageref{LastPage} \\
+\hline
+\end{tabular}
+\end{center}
+\thispagestyle{empty}
+{{.IncludeText}}
+\end {document}`
+
+// unicodeTemplateString is for xelatex and lualatex. Characters outside the
+// mono font come wrapped in \ucrun and are set in the first fallback font
+// that has them, or printed as "?".
+const unicodeTemplateString = `\documentclass[12pt,a4paper,oneside]{article}
+\usepackage{fontspec}
+\usepackage[english,russian]{babel}
+\usepackage{fancyhdr}
+\usepackage{fancyvrb}
+\usepackage{lastpage}
+\usepackage{latexsym}
+\usepackage{amsmath}
+\usepackage{color}
+\usepackage{alltt}
+\usepackage{marvosym}
+\setmonofont{ {{- .MonoFont}}}
+\renewcommand{\familydefault}{\ttdefault}
+\makeatletter
+{{range $i, $font := .FallbackFonts}}\expandafter\newfontfamily\csname uc@font{{$i}}\endcsname{ {{- $font}}}
+{{end}}\def\ucrun#1#2{\iffontchar\font` + "`" + `#1 #2\else\uc@try{0}{#1}{#2}\fi}
+\def\uc@try#1#2#3{\ifcsname uc@font#1\endcsname%
+    {\csname uc@font#1\endcsname\iffontchar\font` + "`" + `#2 #3\else\expandafter\uc@try\expandafter{\the\numexpr#1+1\relax}{#2}{#3}\fi}%
+  \else ?\fi}
+\makeatother
+\pagestyle{fancy}
+\lhead{({{.GetComputer.GetId}}) {{.GetComputer.GetName}}}
+\chead{}
+\rhead{({{.GetTeam.GetId}}) {{.GetTeam.GetName}}}
+\lfoot{({{.GetArea.GetId}}) {{.GetArea.GetName}}}
+\cfoot{ {{.GetFilename}}}
+\rfoot{\thepage\ of \pageref{LastPage}}
+{{.StyleText}}
+\hoffset=-20mm
+\voffset=-20mm
+\setlength\textheight{245mm}
+\setlength\textwidth{175mm}
+\fancyhfoffset{0cm}
+\title{ {{.GetFilename}}}
+\begin{document}
+
+\begin{center}
+\begin{tabular}{|l|p{11cm}|}
+\hline
+Team & ({{.GetTeam.GetId}}) {{.GetTeam.GetName}} \\
+\hline
+Computer & ({{.GetComputer.GetId}}) {{.GetComputer.GetName}} \\
+\hline
+Location & ({{.GetArea.GetId}}) {{.GetArea.GetName}} \\
+\hline
+File name & {{.GetFilename}} \\
+\hline
+Contest & ({{.GetContest.GetId}}) {{.GetContest.GetName}} \\
+\hline
+Encoding & {{.Encoding}} \\
+\hline
 Pages & \pageref{LastPage} \\
 \hline
 \end{tabular}
@@ -63,81 +132,156 @@ Pages & \pageref{LastPage} \\
 {{.IncludeText}}
 \end {document}`
 
-var documentTemplate = template.Must(template.New("source").Parse(documentTemplateString))
+var (
+	documentTemplate = template.Must(parseTeXTemplate("source", documentTemplateString, false))
+	unicodeTemplate  = template.Must(parseTeXTemplate("unicode", unicodeTemplateString, true))
+)
 
+// templateData is escaped by the template, except for the rawTeX fields.
 type templateData struct {
 	*tpb.PrintJob
-	StyleText, IncludeText string
+	StyleText, IncludeText rawTeX
 	Encoding               string
+
+	// Fonts of the Unicode template.
+	MonoFont      string
+	FallbackFonts []string
+}
+
+// requestedLanguageRe is what a language requested in a job may look like.
+var requestedLanguageRe = regexp.MustCompile(`^[a-z0-9+#-]+$`)
+
+// sourceLanguage picks the language of a job: the one requested in the job if
+// it names a known lexer, else the one mapped from the file extension, else
+// the detected one if the detector is confident enough, else plain text. It
+// also says which it was.
+func (s *server) sourceLanguage(job *tpb.PrintJob, text string) (string, string) {
+	v := job.GetLanguage()
+	if v == "" {
+		return s.guessLanguage(job, text)
+	}
+	lang := v
+	if mapped := s.languageMap[v]; mapped != "" {
+		lang = mapped
+	}
+	if requestedLanguageRe.MatchString(v) && knownLexer(lang) {
+		return lang, "requested"
+	}
+	lang, reason := s.guessLanguage(job, text)
+	return lang, fmt.Sprintf("%s, requested %q is unknown", reason, v)
+}
+
+// guessLanguage picks the language of a job from its file name and content.
+func (s *server) guessLanguage(job *tpb.PrintJob, text string) (string, string) {
+	var mapped string
+	if ext := filepath.Ext(job.GetFilename()); ext != "" {
+		mapped = s.languageMap[ext[1:]]
+	}
+	if mapped != "" && mapped != "text" && mapped != "txt" {
+		return mapped, "from extension"
+	}
+
+	if lang, confidence := detectLanguage([]byte(text)); lang != "" && confidence >= s.DetectThreshold {
+		return lang, fmt.Sprintf("detected with confidence %.2f", confidence)
+	}
+	if mapped != "" {
+		return mapped, "from extension"
+	}
+	return "text", "unknown"
 }
 
-func texEscape(s string) string {
-	s = strings.Replace(s, "%", "\\%", -1)
-	s = strings.Replace(s, "$", "\\$", -1)
-	s = strings.Replace(s, "_", "\\_", -1)
-	s = strings.Replace(s, "{", "\\{", -1)
-	s = strings.Replace(s, "#", "\\#", -1)
-	return s
+// unicodeFallback decides whether a job printed with engine needs the
+// Unicode template: always with a Unicode engine, and with UnicodeEngine
+// instead of engine if the text has characters the default fonts lack. It
+// returns the engine to use and, if it changed, why.
+func (s *server) unicodeFallback(job *tpb.PrintJob, text, engine string) (string, string, bool) {
+	if unicodeEngines[engine] {
+		return engine, "", true
+	}
+	fields := []string{text, job.GetFilename(), job.GetTeam().GetName(), job.GetComputer().GetName(), job.GetArea().GetName(), job.GetContest().GetName()}
+	chars := unicodeRunes(strings.Join(fields, "\n"))
+	if len(chars) == 0 {
+		return engine, "", false
+	}
+
+	examples := make([]string, 0, 3)
+	for _, c := range chars[:min(len(chars), cap(examples))] {
+		examples = append(examples, fmt.Sprintf("%#U", c))
+	}
+	return s.UnicodeEngine, fmt.Sprintf("rendered with %s and Unicode fonts instead of %s: %d characters outside the default fonts, such as %s",
+		s.UnicodeEngine, engine, len(chars), strings.Join(examples, ", ")), true
 }
 
-func (s *server) processSource(ctx context.Context, job *tpb.PrintJob) ([]byte, error) {
+// processSource renders a job as a document for engine. It returns a TexJob
+// with the document, the engine to typeset it with and, if that isn't engine,
+// why, along with how the source was highlighted.
+func (s *server) processSource(ctx context.Context, job *tpb.PrintJob, engine string) (*tpb.TexJob, error) {
 	jobID := job.GetJobId()
-	job.Team.Name = texEscape(job.Team.GetName())
 
 	jobDir := filepath.Join(s.SourceDir, jobID)
 	if err := os.MkdirAll(jobDir, os.ModePerm); err != nil {
 		return nil, err
 	}
 
-	sourceLang := filepath.Ext(job.GetFilename())
-	if sourceLang != "" {
-		sourceLang = s.languageMap[sourceLang[1:]]
+	text, charset, err := toUTF8(job.GetData(), job.GetCharset())
+	if err != nil {
+		return nil, err
 	}
-	if sourceLang == "" {
-		sourceLang = "txt"
+	tools.Log(ctx).WithField("charset", charset).Infof("source charset is %s", charset)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("job.charset", charset))
+
+	engine, fallback, unicodeFonts := s.unicodeFallback(job, text, engine)
+	if fallback != "" {
+		tools.Log(ctx).WithField("engine", engine).Infof("%s", fallback)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("job.fallback", fallback))
 	}
 
-	sourceName := fmt.Sprintf("%s-source.%s", jobID, sourceLang)
-	outputName := fmt.Sprintf("%s-hl.tex", jobID)
+	sourceLang, reason := s.sourceLanguage(job, text)
 
-	if err := os.WriteFile(filepath.Join(jobDir, sourceName), job.GetData(), os.ModePerm); err != nil {
-		return nil, err
-	}
+	sourceName := jobID + "-source.txt"
 
-	sourceCharset := job.GetCharset()
-	if sourceCharset == "" {
-		sourceCharset = "cp1251"
+	if err := os.WriteFile(filepath.Join(jobDir, sourceName), []byte(text), os.ModePerm); err != nil {
+		return nil, err
 	}
 
-	args := []string{"-l", "text", "-f", "latex", "-O", "linenos=1,tabsize=4,outencoding=utf8,encoding=" + sourceCharset, "-o", outputName, sourceName}
-	cmd := exec.Command("pygmentize", args...)
-	cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = jobDir, os.Stdin, os.Stdout, os.Stderr
-	if err := cmd.Run(); err != nil {
+	includeText, lexer, err := s.highlighter.Highlight(ctx, jobDir, sourceName, sourceLang)
+	if err != nil {
 		return nil, err
 	}
+	language := fmt.Sprintf("%s (%s), lexer %s", sourceLang, reason, lexer)
+	tools.Log(ctx).WithFields(log.Fields{"language": sourceLang, "lexer": lexer}).Infof("highlighted %q as %s", job.GetFilename(), language)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("job.language", language))
+	if unicodeFonts {
+		includeText = wrapUnicode(includeText)
+	}
 
-	cmd = exec.Command("pygmentize", "-f", "latex", "-S", "bw")
-	styleBytes, err := cmd.Output()
+	styleText, err := s.highlighter.Style(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	job.Filename = texEscape(job.GetFilename())
 	data := templateData{
-		PrintJob: job,
+		PrintJob:      job,
+		IncludeText:   rawTeX(includeText),
+		StyleText:     rawTeX(styleText),
+		Encoding:      charset,
+		MonoFont:      s.MonoFont,
+		FallbackFonts: s.FallbackFonts,
 	}
 
-	bs, err := os.ReadFile(filepath.Join(jobDir, outputName))
-	if err != nil {
-		return nil, err
-	}
-	data.IncludeText = string(bs)
-	data.StyleText = string(styleBytes)
+	tmpl, tmplName := s.templates.lookup(job, unicodeFonts)
+	tools.Log(ctx).WithField("template", tmplName).Infof("rendering with template %s", tmplName)
 
 	var output bytes.Buffer
-	if err = documentTemplate.Execute(&output, &data); err != nil {
+	if err = tmpl.Execute(&output, &data); err != nil {
 		return nil, err
 	}
 
-	return output.Bytes(), nil
+	return &tpb.TexJob{
+		Data:     output.Bytes(),
+		Engine:   engine,
+		Fallback: fallback,
+		Language: language,
+		Charset:  charset,
+	}, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	s := &server{
+		bconfig: bconfig{
+			SourceDir:       t.TempDir(),
+			DetectThreshold: 0.6,
+			TexEngine:       "latex",
+			UnicodeEngine:   "xelatex",
+			MonoFont:        "DejaVu Sans Mono",
+		},
+		languageMap: map[string]string{"cpp": "cpp", "py": "python", "txt": "text", "foo": "nosuchlexer"},
+		templates:   newTemplateSet(""),
+	}
+	var err error
+	if s.highlighter, err = newHighlighter("chroma"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestProcessSource(t *testing.T) {
+	s := newTestServer(t)
+	for _, tt := range []struct {
+		filename, language, data string
+		engine, wantLanguage     string
+		wantFallback             bool
+	}{
+		{filename: "sol.cpp", data: "int main() {}\n", engine: "latex", wantLanguage: "cpp (from extension), lexer C++"},
+		{filename: "sol.txt", language: "py", data: "print(1)\n", engine: "pdflatex", wantLanguage: "python (requested), lexer Python"},
+		{filename: "sol.foo", data: "x\n", engine: "latex", wantLanguage: "nosuchlexer (from extension), lexer fallback"},
+		{filename: "notes", data: "just some words\n", engine: "latex", wantLanguage: "text (unknown), lexer plaintext"},
+		{filename: "sol.cpp", data: "// π\nint main() {}\n", engine: "latex", wantLanguage: "cpp (from extension), lexer C++", wantFallback: true},
+	} {
+		job := &tpb.PrintJob{JobId: "job1", Filename: tt.filename, Language: tt.language, Data: []byte(tt.data), Charset: "utf-8"}
+		tex, err := s.processSource(context.Background(), job, tt.engine)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filename, err)
+			continue
+		}
+		if tex.GetLanguage() != tt.wantLanguage {
+			t.Errorf("%s: language = %q, want %q", tt.filename, tex.GetLanguage(), tt.wantLanguage)
+		}
+		if wantEngine := map[bool]string{false: tt.engine, true: "xelatex"}[tt.wantFallback]; tex.GetEngine() != wantEngine || (tex.GetFallback() != "") != tt.wantFallback {
+			t.Errorf("%s: engine %q, fallback %q", tt.filename, tex.GetEngine(), tex.GetFallback())
+		}
+		if !bytes.Contains(tex.GetData(), []byte(`\begin{document}`)) {
+			t.Errorf("%s: rendered document lacks \\begin{document}", tt.filename)
+		}
+	}
+	for charset, want := range map[string]string{"": "windows-1251 (detected)", "auto": "windows-1251 (detected)", "cp1251": "cp1251"} {
+		// "привет мир" in windows-1251.
+		job := &tpb.PrintJob{JobId: "job2", Filename: "sol.cpp", Charset: charset, Data: []byte("// \xef\xf0\xe8\xe2\xe5\xf2 \xec\xe8\xf0\nint main() {}\n")}
+		tex, err := s.processSource(context.Background(), job, "latex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tex.GetCharset() != want {
+			t.Errorf("charset %q: reported %q, want %q", charset, tex.GetCharset(), want)
+		}
+	}
+}
@@ -9,66 +9,154 @@ import (
 	"regexp"
 	"strconv"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/contester/printing3/tools"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var pagesRe = regexp.MustCompile(`^*.dvi: (\d+) page`)
 
-func (s *server) processTex(ctx context.Context, jobID string, content []byte) ([]byte, int64, error) {
+func runCmd(cmd *exec.Cmd) func(context.Context) error {
+	return func(context.Context) error {
+		return cmd.Run()
+	}
+}
+
+// MIME types of the BinaryJob data.
+const (
+	mimePostScript = "application/postscript"
+	mimePDF        = "application/pdf"
+)
+
+// texEngines maps the engines to the MIME type of what they produce. latex
+// makes DVI, which is converted to PostScript for printers that need it.
+var texEngines = map[string]string{
+	"latex":    mimePostScript,
+	"pdflatex": mimePDF,
+	"xelatex":  mimePDF,
+	"lualatex": mimePDF,
+}
+
+// unicodeEngines can typeset the Unicode template.
+var unicodeEngines = map[string]bool{
+	"xelatex":  true,
+	"lualatex": true,
+}
+
+// engineFor returns the engine for jobs sent to printer.
+func (s *server) engineFor(printer string) string {
+	if v, ok := s.printerEngines[printer]; ok {
+		return v
+	}
+	return s.TexEngine
+}
+
+// processTex typesets a document with engine, or the engine of the printer
+// if it is empty, and returns the output, its page count and MIME type.
+func (s *server) processTex(ctx context.Context, jobID, printer, engine string, content []byte) ([]byte, int64, string, error) {
+	if engine == "" {
+		engine = s.engineFor(printer)
+	}
+	mimeType, ok := texEngines[engine]
+	if !ok {
+		return nil, 0, "", fmt.Errorf("unknown TeX engine %q", engine)
+	}
+
 	jobDir := filepath.Join(s.TexDir, jobID)
 	if err := os.MkdirAll(jobDir, os.ModePerm); err != nil {
-		return nil, 0, err
+		return nil, 0, "", err
 	}
 
 	sourceName := fmt.Sprintf("%s.tex", jobID)
 
 	if err := os.WriteFile(filepath.Join(jobDir, sourceName), content, os.ModePerm); err != nil {
-		return nil, 0, err
+		return nil, 0, "", err
 	}
 
-	cmd := exec.CommandContext(ctx, "latex", "-interaction=batchmode", sourceName)
-	cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = jobDir, os.Stdin, os.Stdout, os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Infof("first latex run has error %v. Rerunning", err)
+	// The second run resolves the page references.
+	for run := 1; run <= 2; run++ {
+		cmd := exec.CommandContext(ctx, engine, "-interaction=batchmode", sourceName)
+		cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = jobDir, os.Stdin, os.Stdout, os.Stderr
+		if err := tools.Traced(ctx, engine, runCmd(cmd), attribute.String("tex.engine", engine), attribute.Int("latex.run", run)); err != nil {
+			tools.Log(ctx).Infof("%s run %d has error %v, ignoring", engine, run, err)
+		}
 	}
 
-	cmd = exec.CommandContext(ctx, "latex", "-interaction=batchmode", sourceName)
-	cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = jobDir, os.Stdin, os.Stdout, os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Infof("seconf latex run has error %v. Ignoring because I'm too lazy", err)
+	var (
+		data  []byte
+		pages int64
+		err   error
+	)
+	if mimeType == mimePDF {
+		data, pages, err = pdfOutput(jobDir, jobID)
+	} else {
+		data, pages, err = s.dvipsOutput(ctx, jobDir, jobID)
 	}
+	return data, pages, mimeType, err
+}
 
+func pdfOutput(jobDir, jobID string) ([]byte, int64, error) {
+	data, err := os.ReadFile(filepath.Join(jobDir, fmt.Sprintf("%s.pdf", jobID)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't find pdf file: %v", err)
+	}
+	pages, err := pdfPageCount(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to count pages: %v", err)
+	}
+	return data, pages, nil
+}
+
+func (s *server) dvipsOutput(ctx context.Context, jobDir, jobID string) ([]byte, int64, error) {
 	dviName := fmt.Sprintf("%s.dvi", jobID)
 
-	if _, err := os.Stat(filepath.Join(cmd.Dir, dviName)); err != nil {
+	dvi, err := os.ReadFile(filepath.Join(jobDir, dviName))
+	if err != nil {
 		return nil, 0, fmt.Errorf("can't find dvi file: %v", err)
 	}
 
-	cmd = exec.CommandContext(ctx, "dviinfox", "-p", dviName)
+	pages, err := dviPageCount(dvi)
+	if err != nil {
+		if !s.DviinfoxFallback {
+			return nil, 0, fmt.Errorf("unable to count pages: %v", err)
+		}
+		tools.Log(ctx).Warnf("unable to count pages: %v, running dviinfox", err)
+		if pages, err = dviinfoxPages(ctx, jobDir, dviName); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "dvips", "-t", "a4", dviName)
+	cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = jobDir, os.Stdin, os.Stdout, os.Stderr
+	if err := tools.Traced(ctx, "dvips", runCmd(cmd)); err != nil {
+		return nil, pages, err
+	}
+
+	psName := fmt.Sprintf("%s.ps", jobID)
+	data, err := os.ReadFile(filepath.Join(jobDir, psName))
+	return data, pages, err
+}
+
+func dviinfoxPages(ctx context.Context, jobDir, dviName string) (int64, error) {
+	cmd := exec.CommandContext(ctx, "dviinfox", "-p", dviName)
 	cmd.Dir = jobDir
 
-	pagesTxt, err := cmd.CombinedOutput()
+	var pagesTxt []byte
+	err := tools.Traced(ctx, "dviinfox", func(context.Context) (err error) {
+		pagesTxt, err = cmd.CombinedOutput()
+		return err
+	})
 	if err != nil {
-		return nil, 0, fmt.Errorf("unable to retrieve number of pages")
+		return 0, fmt.Errorf("unable to retrieve number of pages")
 	}
 
 	groups := pagesRe.FindSubmatch(pagesTxt)
 	if len(groups) < 2 {
-		return nil, 0, fmt.Errorf("unable to find pages in %q", string(pagesTxt))
+		return 0, fmt.Errorf("unable to find pages in %q", string(pagesTxt))
 	}
 
 	pages, err := strconv.ParseInt(string(groups[1]), 10, 64)
 	if err != nil {
-		return nil, 0, fmt.Errorf("unable to parse pages into int: %q %v", string(groups[1]), err)
+		return 0, fmt.Errorf("unable to parse pages into int: %q %v", string(groups[1]), err)
 	}
-
-	cmd = exec.CommandContext(ctx, "dvips", "-t", "a4", dviName)
-	cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = jobDir, os.Stdin, os.Stdout, os.Stderr
-	if err := cmd.Run(); err != nil {
-		return nil, pages, err
-	}
-
-	psName := fmt.Sprintf("%s.ps", jobID)
-	data, err := os.ReadFile(filepath.Join(jobDir, psName))
-	return data, pages, err
+	return pages, nil
 }
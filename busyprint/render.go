@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+// render writes the LaTeX document for a source file to w, so a template can
+// be previewed without a broker. The job fields not given in jobFile, a
+// PrintJob in JSON, come from sampleJob.
+func (s *server) render(ctx context.Context, w io.Writer, sourceFile, jobFile string) error {
+	job := sampleJob()
+	job.Filename = filepath.Base(sourceFile)
+
+	if jobFile != "" {
+		bs, err := os.ReadFile(jobFile)
+		if err != nil {
+			return err
+		}
+		var given tpb.PrintJob
+		if err := protojson.Unmarshal(bs, &given); err != nil {
+			return err
+		}
+		proto.Merge(job, &given)
+	}
+
+	var err error
+	if job.Data, err = os.ReadFile(sourceFile); err != nil {
+		return err
+	}
+
+	if s.SourceDir == "" {
+		if s.SourceDir, err = os.MkdirTemp("", "busyprint-render"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(s.SourceDir)
+	}
+
+	tex, err := s.processSource(ctx, job, s.engineFor(job.GetPrinter()))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(tex.GetData())
+	return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	tpb "github.com/contester/printing3/tickets"
+	log "github.com/sirupsen/logrus"
+)
+
+// templateExt is the extension of template files in the template directory.
+const templateExt = ".tex.tmpl"
+
+// unicodeSuffix ends the names of Unicode templates, see templateData.
+const unicodeSuffix = "-unicode"
+
+// reloadDelay lets an editor finish writing before templates are reloaded.
+const reloadDelay = 500 * time.Millisecond
+
+// sampleJob is what templates are validated against, and what the render mode
+// fills in when the job doesn't say.
+func sampleJob() *tpb.PrintJob {
+	return &tpb.PrintJob{
+		Filename: "sample.cpp",
+		Contest:  &tpb.IdName{Id: 1, Name: "Sample contest"},
+		Team:     &tpb.IdName{Id: 1, Name: "Sample team"},
+		Computer: &tpb.Computer{Id: "10.0.0.1", Name: "Sample computer"},
+		Area:     &tpb.IdName{Id: 1, Name: "Sample area"},
+		Printer:  "sample",
+		JobId:    "sample",
+	}
+}
+
+// parseTemplateFile parses a document template and checks that it renders
+// the sample job, including the highlighting style and the source. Templates
+// named with unicodeSuffix are Unicode templates.
+func parseTemplateFile(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	unicodeFonts := strings.HasSuffix(strings.TrimSuffix(filepath.Base(path), templateExt), unicodeSuffix)
+	t, err := parseTeXTemplate(filepath.Base(path), string(text), unicodeFonts)
+	if err != nil {
+		return nil, err
+	}
+
+	const style, include = `\sampleStyle`, `\sampleSource`
+	var output bytes.Buffer
+	if err := t.Execute(&output, &templateData{PrintJob: sampleJob(), StyleText: style, IncludeText: include, Encoding: "utf-8", MonoFont: "Sample Mono", FallbackFonts: []string{"Sample Fallback"}}); err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(output.Bytes(), []byte(style)) {
+		return nil, fmt.Errorf("%s: template doesn't include .StyleText", path)
+	}
+	if !bytes.Contains(output.Bytes(), []byte(include)) {
+		return nil, fmt.Errorf("%s: template doesn't include .IncludeText", path)
+	}
+	return t, nil
+}
+
+// templateSet holds the document templates of the template directory, each
+// file NAME.tex.tmpl under its NAME. A job is rendered with the first of
+// contest-C-area-A, area-A, contest-C and default there is, or with the
+// built-in documentTemplate. Jobs that need Unicode fonts look for the same
+// names with unicodeSuffix, then fall back to the built-in unicodeTemplate.
+type templateSet struct {
+	dir string
+
+	mu        sync.RWMutex
+	templates map[string]*template.Template
+}
+
+func newTemplateSet(dir string) *templateSet {
+	result := &templateSet{dir: dir, templates: make(map[string]*template.Template)}
+	result.load()
+	return result
+}
+
+// load reads the template directory. A template that fails validation keeps
+// its previous version, so a typo can't break printing mid-contest.
+func (ts *templateSet) load() {
+	if ts.dir == "" {
+		return
+	}
+	paths, err := filepath.Glob(filepath.Join(ts.dir, "*"+templateExt))
+	if err != nil {
+		log.Errorf("can't list templates in %s: %v", ts.dir, err)
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	templates := make(map[string]*template.Template, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), templateExt)
+		t, err := parseTemplateFile(path)
+		if err != nil {
+			if old, ok := ts.templates[name]; ok {
+				log.Errorf("keeping the previous version of template %q: %v", name, err)
+				templates[name] = old
+			} else {
+				log.Errorf("skipping template %q: %v", name, err)
+			}
+			continue
+		}
+		templates[name] = t
+	}
+	ts.templates = templates
+	log.Infof("loaded %d templates from %s", len(templates), ts.dir)
+}
+
+func templateNames(job *tpb.PrintJob) []string {
+	contest, area := job.GetContest().GetId(), job.GetArea().GetId()
+	return []string{
+		fmt.Sprintf("contest-%d-area-%d", contest, area),
+		fmt.Sprintf("area-%d", area),
+		fmt.Sprintf("contest-%d", contest),
+		"default",
+	}
+}
+
+// lookup returns the template for a job and its name.
+func (ts *templateSet) lookup(job *tpb.PrintJob, unicodeFonts bool) (*template.Template, string) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, name := range templateNames(job) {
+		if unicodeFonts {
+			name += unicodeSuffix
+		}
+		if t, ok := ts.templates[name]; ok {
+			return t, name
+		}
+	}
+	if unicodeFonts {
+		return unicodeTemplate, "built-in" + unicodeSuffix
+	}
+	return documentTemplate, "built-in"
+}
+
+// watch reloads the templates on SIGHUP and when the template directory
+// changes, until ctx is done.
+func (ts *templateSet) watch(ctx context.Context) {
+	if ts.dir == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(ts.dir)
+	}
+	if err != nil {
+		log.Errorf("can't watch %s, templates reload on SIGHUP only: %v", ts.dir, err)
+	} else {
+		events = watcher.Events
+		go func() {
+			for err := range watcher.Errors {
+				log.Errorf("watching %s: %v", ts.dir, err)
+			}
+		}()
+	}
+
+	reload := time.NewTimer(reloadDelay)
+	reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			ts.load()
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if strings.HasSuffix(ev.Name, templateExt) {
+				reload.Reset(reloadDelay)
+			}
+		case <-reload.C:
+			ts.load()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+// writeTemplate writes a template that renders as its marker followed by the
+// team name, the style and the source.
+func writeTemplate(t *testing.T, dir, name, marker string) {
+	t.Helper()
+	text := marker + " {{.GetTeam.GetName}}\n{{.StyleText}}\n{{.IncludeText}}\n"
+	if err := os.WriteFile(filepath.Join(dir, name+templateExt), []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// marker returns the marker of the template ts would render job with.
+func marker(t *testing.T, ts *templateSet, job *tpb.PrintJob, unicodeFonts bool) (string, string) {
+	t.Helper()
+	tmpl, name := ts.lookup(job, unicodeFonts)
+	var output bytes.Buffer
+	if err := tmpl.Execute(&output, &templateData{PrintJob: job}); err != nil {
+		t.Fatal(err)
+	}
+	first, _, _ := strings.Cut(output.String(), " ")
+	return first, name
+}
+
+func testJob() *tpb.PrintJob {
+	return &tpb.PrintJob{
+		Contest: &tpb.IdName{Id: 3},
+		Area:    &tpb.IdName{Id: 7},
+		Team:    &tpb.IdName{Name: "Team_1"},
+	}
+}
+
+func TestTemplateNames(t *testing.T) {
+	want := []string{"contest-3-area-7", "area-7", "contest-3", "default"}
+	if got := templateNames(testJob()); !reflect.DeepEqual(got, want) {
+		t.Errorf("templateNames = %q, want %q", got, want)
+	}
+	want = []string{"contest-0-area-0", "area-0", "contest-0", "default"}
+	if got := templateNames(&tpb.PrintJob{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("templateNames of an empty job = %q, want %q", got, want)
+	}
+}
+
+func TestTemplateLookup(t *testing.T) {
+	names := []string{"contest-3-area-7", "area-7", "contest-3", "default"}
+	for _, unicodeFonts := range []bool{false, true} {
+		suffix := ""
+		if unicodeFonts {
+			suffix = unicodeSuffix
+		}
+		// Each step removes the template found by the previous one.
+		dir := t.TempDir()
+		for _, v := range names {
+			writeTemplate(t, dir, v, v)
+			writeTemplate(t, dir, v+unicodeSuffix, v+unicodeSuffix)
+		}
+		// Templates of other contests and areas are never picked.
+		writeTemplate(t, dir, "contest-4-area-7", "contest-4-area-7")
+		writeTemplate(t, dir, "area-3", "area-3")
+		for _, v := range names {
+			got, name := marker(t, newTemplateSet(dir), testJob(), unicodeFonts)
+			if want := v + suffix; got != want || name != want {
+				t.Errorf("unicode %v: lookup = %q, rendering %q, want %q", unicodeFonts, name, got, want)
+			}
+			if err := os.Remove(filepath.Join(dir, v+suffix+templateExt)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tmpl, name := newTemplateSet(dir).lookup(testJob(), unicodeFonts)
+		wantTmpl := documentTemplate
+		if unicodeFonts {
+			wantTmpl = unicodeTemplate
+		}
+		if want := "built-in" + suffix; name != want || tmpl != wantTmpl {
+			t.Errorf("unicode %v: lookup without templates = %q, want %q", unicodeFonts, name, want)
+		}
+	}
+}
+
+func TestTemplateLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "default", "v1")
+	ts := newTemplateSet(dir)
+	if got, _ := marker(t, ts, testJob(), false); got != "v1" {
+		t.Fatalf("loaded %q, want v1", got)
+	}
+
+	for _, broken := range []string{
+		"v2 {{.GetTeam.GetName",
+		"v2 {{.NoSuchField}} {{.StyleText}} {{.IncludeText}}",
+		"v2 {{.StyleText}}",
+		"v2 {{.IncludeText}}",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "default"+templateExt), []byte(broken), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// A broken template with no previous version is skipped.
+		if err := os.WriteFile(filepath.Join(dir, "area-7"+templateExt), []byte(broken), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ts.load()
+		if got, name := marker(t, ts, testJob(), false); got != "v1" || name != "default" {
+			t.Errorf("after loading %q, lookup = %q, rendering %q, want the previous default", broken, name, got)
+		}
+	}
+
+	writeTemplate(t, dir, "default", "v2")
+	ts.load()
+	if got, _ := marker(t, ts, testJob(), false); got != "v2" {
+		t.Errorf("after fixing the template, rendering %q, want v2", got)
+	}
+
+	os.Remove(filepath.Join(dir, "default"+templateExt))
+	ts.load()
+	if _, name := ts.lookup(testJob(), false); name != "built-in" {
+		t.Errorf("after removing the template, lookup = %q, want built-in", name)
+	}
+}
+
+func TestTemplateWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "default", "v1")
+	ts := newTemplateSet(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ts.watch(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The watcher may not be watching yet, so keep changing the file.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		writeTemplate(t, dir, "default", "v2")
+		writeTemplate(t, dir, "contest-3", "contest-3")
+		time.Sleep(reloadDelay + 100*time.Millisecond)
+		if got, _ := marker(t, ts, testJob(), false); got == "contest-3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("templates not reloaded after a change")
+		}
+	}
+	if got, _ := marker(t, ts, &tpb.PrintJob{}, false); got != "v2" {
+		t.Errorf("changed default template renders %q, want v2", got)
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "default", "default")
+	writeTemplate(t, dir, "contest-3", "contest-3")
+	writeTemplate(t, dir, "contest-3"+unicodeSuffix, "contest-3-unicode")
+
+	jobFile := filepath.Join(t.TempDir(), "job.json")
+	if err := os.WriteFile(jobFile, []byte(`{"contest": {"id": 3}, "team": {"name": "Team_1"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		source, job, want string
+	}{
+		{"int main() {}\n", "", "default Sample team\n"},
+		{"int main() {}\n", jobFile, "contest-3 Team\\_1\n"},
+		{"int main() { return '日'; }\n", jobFile, "contest-3-unicode Team\\_1\n"},
+	} {
+		s := newTestServer(t)
+		s.SourceDir = ""
+		s.templates = newTemplateSet(dir)
+		source := filepath.Join(t.TempDir(), "a.cpp")
+		if err := os.WriteFile(source, []byte(tt.source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		var output bytes.Buffer
+		if err := s.render(context.Background(), &output, source, tt.job); err != nil {
+			t.Fatal(err)
+		}
+		got := output.String()
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("render(%q, %q) = %q, want it to start with %q", tt.source, tt.job, got, tt.want)
+		}
+		if !strings.Contains(got, `\def\PY#1#2`) || !strings.Contains(got, `\PY{kt}{int}`) {
+			t.Errorf("render(%q, %q) doesn't have the style and the highlighted source:\n%s", tt.source, tt.job, got)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+#include <stdio.h>
+
+// Prints "a\\b" & {braces} 100% - it's
+int main() {
+	if (1 < 2) {
+		printf("%s\n", "x_y~$#^");
+	}
+	return 0;
+}
+
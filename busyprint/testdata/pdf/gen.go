@@ -0,0 +1,207 @@
+//go:build ignore
+
+// Gen writes the test PDFs in this directory, each in the layout of a writer
+// pdfPageCount has to handle:
+//
+//	pdftex.pdf  8 pages as pdfTeX 1.40 writes them with \pdfobjcompresslevel=2:
+//	            the page tree, in leaves of 6 pages, and the catalog in an
+//	            object stream, and an xref stream naming the catalog
+//	objstm.pdf  3 pages as xdvipdfmx writes them: the page objects in an
+//	            object stream whose /Length is an indirect object
+//	update.pdf  3 pages, then an incremental update that drops the last one
+//
+// Run it with go run gen.go.
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+type object struct {
+	num  int
+	body string
+}
+
+type writer struct {
+	buf bytes.Buffer
+	// xref holds the xref stream entries: type, offset or object stream,
+	// generation or index.
+	xref map[int][3]int
+}
+
+func newWriter() *writer {
+	w := &writer{xref: map[int][3]int{0: {0, 0, 65535}}}
+	w.buf.WriteString("%PDF-1.5\n%\xd0\xd4\xc5\xd8\n")
+	return w
+}
+
+func deflate(data []byte) []byte {
+	var b bytes.Buffer
+	z := zlib.NewWriter(&b)
+	z.Write(data)
+	z.Close()
+	return b.Bytes()
+}
+
+func (w *writer) direct(num int, body string) {
+	w.xref[num] = [3]int{1, w.buf.Len(), 0}
+	fmt.Fprintf(&w.buf, "%d 0 obj\n%s\nendobj\n", num, body)
+}
+
+// stream writes a Flate-compressed stream. If lengthNum isn't 0, its length is
+// written as that object.
+func (w *writer) stream(num int, dict string, data []byte, lengthNum int) {
+	z := deflate(data)
+	length := fmt.Sprint(len(z))
+	if lengthNum != 0 {
+		length = fmt.Sprintf("%d 0 R", lengthNum)
+	}
+	w.direct(num, fmt.Sprintf("<<%s/Length %s/Filter/FlateDecode>>\nstream\n%s\nendstream", dict, length, z))
+	if lengthNum != 0 {
+		w.direct(lengthNum, fmt.Sprint(len(z)))
+	}
+}
+
+func (w *writer) objStm(num int, objs []object, lengthNum int) {
+	var header, body strings.Builder
+	for i, v := range objs {
+		fmt.Fprintf(&header, "%d %d ", v.num, body.Len())
+		body.WriteString(v.body + "\n")
+		w.xref[v.num] = [3]int{2, num, i}
+	}
+	dict := fmt.Sprintf("/Type/ObjStm/N %d/First %d", len(objs), header.Len())
+	w.stream(num, dict, []byte(header.String()+body.String()), lengthNum)
+}
+
+// xrefStream ends the file with an xref stream.
+func (w *writer) xrefStream(num int, root int) {
+	size := num + 1
+	w.xref[num] = [3]int{1, w.buf.Len(), 0}
+	var data bytes.Buffer
+	for i := 0; i < size; i++ {
+		e := w.xref[i]
+		data.WriteByte(byte(e[0]))
+		binary.Write(&data, binary.BigEndian, uint32(e[1]))
+		binary.Write(&data, binary.BigEndian, uint16(e[2]))
+	}
+	offset := w.buf.Len()
+	z := deflate(data.Bytes())
+	fmt.Fprintf(&w.buf, "%d 0 obj\n<</Type/XRef/Root %d 0 R/Size %d/W[1 4 2]/Length %d/Filter/FlateDecode>>\nstream\n%s\nendstream\nendobj\n", num, root, size, len(z), z)
+	fmt.Fprintf(&w.buf, "startxref\n%d\n%%%%EOF\n", offset)
+}
+
+// xrefTable ends the file or an update with an xref table of the direct
+// objects from first to end, in a file of size objects.
+func (w *writer) xrefTable(first, end, size, root, prev int) int {
+	offset := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n")
+	if first > 0 {
+		fmt.Fprintf(&w.buf, "0 1\n0000000000 65535 f \n")
+	}
+	fmt.Fprintf(&w.buf, "%d %d\n", first, end-first)
+	for i := first; i < end; i++ {
+		if e, ok := w.xref[i]; ok && e[0] == 1 {
+			fmt.Fprintf(&w.buf, "%010d %05d n \n", e[1], e[2])
+		} else {
+			fmt.Fprintf(&w.buf, "0000000000 65535 f \n")
+		}
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<</Size %d/Root %d 0 R", size, root)
+	if prev > 0 {
+		fmt.Fprintf(&w.buf, "/Prev %d", prev)
+	}
+	fmt.Fprintf(&w.buf, ">>\nstartxref\n%d\n%%%%EOF\n", offset)
+	return offset
+}
+
+func content(page int) []byte {
+	return []byte(fmt.Sprintf("BT /F1 12 Tf 72 770 Td (Page %d) Tj ET", page))
+}
+
+func page(num, parent, contents int) object {
+	return object{num, fmt.Sprintf("<</Type/Page/Contents %d 0 R/Resources<</Font<</F1 3 0 R>>>>/MediaBox[0 0 595 842]/Parent %d 0 R>>", contents, parent)}
+}
+
+const font = "<</Type/Font/Subtype/Type1/BaseFont/Courier>>"
+
+func refs(nums ...int) string {
+	s := make([]string, len(nums))
+	for i, v := range nums {
+		s[i] = fmt.Sprintf("%d 0 R", v)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+// pdftex writes 8 pages, contents 10-17 and pages 20-27, in leaves 5 and 6
+// under the root 2.
+func pdftex() []byte {
+	w := newWriter()
+	for i := 0; i < 8; i++ {
+		w.stream(10+i, "", content(i+1), 0)
+	}
+	objs := []object{{3, font}}
+	for i := 0; i < 8; i++ {
+		objs = append(objs, page(20+i, 5+i/6, 10+i))
+	}
+	objs = append(objs,
+		object{5, fmt.Sprintf("<</Type/Pages/Count 6/Parent 2 0 R/Kids%s>>", refs(20, 21, 22, 23, 24, 25))},
+		object{6, fmt.Sprintf("<</Type/Pages/Count 2/Parent 2 0 R/Kids%s>>", refs(26, 27))},
+		object{2, "<</Type/Pages/Count 8/Kids[5 0 R 6 0 R]>>"},
+		object{1, "<</Type/Catalog/Pages 2 0 R>>"},
+	)
+	w.objStm(30, objs, 0)
+	w.xrefStream(31, 1)
+	return w.buf.Bytes()
+}
+
+// objstm writes 3 pages, contents 10-12 and pages 4-6 in object stream 7.
+func objstm() []byte {
+	w := newWriter()
+	w.direct(1, "<</Type/Catalog/Pages 2 0 R>>")
+	w.direct(2, fmt.Sprintf("<</Type/Pages/Count 3/Kids%s>>", refs(4, 5, 6)))
+	w.direct(3, font)
+	w.objStm(7, []object{page(4, 2, 10), page(5, 2, 11), page(6, 2, 12)}, 8)
+	for i := 0; i < 3; i++ {
+		w.stream(10+i, "", content(i+1), 0)
+	}
+	w.xrefStream(13, 1)
+	return w.buf.Bytes()
+}
+
+// update writes 3 pages, then an update that takes the last out of the page
+// tree, leaving its page object behind.
+func update() []byte {
+	w := newWriter()
+	w.direct(1, "<</Type/Catalog/Pages 2 0 R>>")
+	w.direct(2, fmt.Sprintf("<</Type/Pages/Count 3/Kids%s>>", refs(4, 5, 6)))
+	w.direct(3, font)
+	for i := 0; i < 3; i++ {
+		p := page(4+i, 2, 10+i)
+		w.direct(p.num, p.body)
+		w.stream(10+i, "", content(i+1), 0)
+	}
+	prev := w.xrefTable(0, 13, 13, 1, 0)
+
+	w.xref = map[int][3]int{}
+	w.direct(2, fmt.Sprintf("<</Type/Pages/Count 2/Kids%s>>", refs(4, 5)))
+	w.xrefTable(2, 3, 13, 1, prev)
+	return w.buf.Bytes()
+}
+
+func main() {
+	for name, data := range map[string][]byte{
+		"pdftex.pdf": pdftex(),
+		"objstm.pdf": objstm(),
+		"update.pdf": update(),
+	} {
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// rawTeX is template data that is already TeX, such as highlighted source,
+// and is inserted as it is.
+type rawTeX string
+
+var texSpecials = map[rune]string{
+	'\\': `\textbackslash{}`,
+	'{':  `\{`,
+	'}':  `\}`,
+	'$':  `\$`,
+	'&':  `\&`,
+	'#':  `\#`,
+	'%':  `\%`,
+	'_':  `\_`,
+	'^':  `\textasciicircum{}`,
+	'~':  `\textasciitilde{}`,
+	'<':  `\textless{}`,
+	'>':  `\textgreater{}`,
+	'|':  `\textbar{}`,
+	// Active in babel russian.
+	'"': "{\\char`\\\"}",
+}
+
+// texPunctuation replaces punctuation that the default fonts may lack.
+var texPunctuation = map[rune]string{
+	'\u00a0': `~`,
+	'—':      `---`,
+	'–':      `--`,
+	'…':      `...`,
+	'«':      "{\\char`\\\"}",
+	'»':      "{\\char`\\\"}",
+	'“':      "{\\char`\\\"}",
+	'”':      "{\\char`\\\"}",
+	'„':      "{\\char`\\\"}",
+	'‘':      `'`,
+	'’':      `'`,
+	'№':      `No.`,
+}
+
+// texSafeRune reports whether inputenc and babel russian can typeset c as
+// it is.
+func texSafeRune(c rune) bool {
+	switch {
+	case c >= 0x20 && c < 0x7f:
+		return true
+	case c >= 0x410 && c <= 0x44f, c == 'ё', c == 'Ё':
+		return true
+	case c >= 0xc0 && c <= 0xff && c != 0xd7 && c != 0xf7:
+		return true
+	}
+	return false
+}
+
+// needsUnicode reports whether c is outside what the fonts of the default
+// template cover.
+func needsUnicode(c rune) bool {
+	_, ok := texPunctuation[c]
+	return !ok && !texSafeRune(c) && !unicode.IsSpace(c) && !unicode.IsControl(c)
+}
+
+// unicodeRunes returns the distinct characters of s that need the Unicode
+// template, in the order they first appear.
+func unicodeRunes(s string) []rune {
+	var result []rune
+	seen := make(map[rune]bool)
+	for _, c := range s {
+		if needsUnicode(c) && !seen[c] {
+			seen[c] = true
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// wrapUnicode puts each run of characters that need the Unicode template into
+// \ucrun{first}{run}, which the template sets in the first of its fonts that
+// has the first character. Runs are kept whole so scripts like Arabic shape.
+func wrapUnicode(s string) string {
+	var b strings.Builder
+	var run []rune
+	flush := func() {
+		if len(run) > 0 {
+			fmt.Fprintf(&b, `\ucrun{%c}{%s}`, run[0], string(run))
+			run = run[:0]
+		}
+	}
+	for _, c := range s {
+		if needsUnicode(c) {
+			run = append(run, c)
+			continue
+		}
+		flush()
+		b.WriteRune(c)
+	}
+	flush()
+	return b.String()
+}
+
+// texEscape turns any value into TeX text that typesets as the value and
+// can't contain commands or unbalanced braces. Characters that can't be
+// typeset become their closest ASCII letter or "?".
+func texEscape(v interface{}) string {
+	return escapeTeX(v, false)
+}
+
+// texEscapeUnicode is texEscape for the Unicode template: characters outside
+// the default fonts are kept and wrapped as wrapUnicode does.
+func texEscapeUnicode(v interface{}) string {
+	return escapeTeX(v, true)
+}
+
+func escapeTeX(v interface{}, unicodeFonts bool) string {
+	var s string
+	switch v := v.(type) {
+	case rawTeX:
+		return string(v)
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	s = norm.NFC.String(strings.ToValidUTF8(s, "?"))
+	var b strings.Builder
+	for _, c := range s {
+		if r, ok := texSpecials[c]; ok {
+			b.WriteString(r)
+			continue
+		}
+		if r, ok := texPunctuation[c]; ok && !unicodeFonts {
+			b.WriteString(r)
+			continue
+		}
+		switch {
+		case texSafeRune(c):
+			b.WriteRune(c)
+		case unicode.IsSpace(c) || unicode.IsControl(c):
+			b.WriteByte(' ')
+		case unicodeFonts:
+			b.WriteRune(c)
+		default:
+			b.WriteString(texFallback(c))
+		}
+	}
+	if unicodeFonts {
+		return wrapUnicode(b.String())
+	}
+	return b.String()
+}
+
+// texFallback strips diacritics off c if that leaves a safe letter.
+func texFallback(c rune) string {
+	var base []rune
+	for _, v := range norm.NFD.String(string(c)) {
+		if unicode.Is(unicode.Mn, v) {
+			continue
+		}
+		if !texSafeRune(v) || texSpecials[v] != "" {
+			return "?"
+		}
+		base = append(base, v)
+	}
+	if len(base) == 0 {
+		return "?"
+	}
+	return string(base)
+}
+
+// parseTeXTemplate parses a document template and makes every action that
+// prints a value escape it with texEscape, or texEscapeUnicode for a Unicode
+// template, much as html/template does for HTML. Values of type rawTeX are
+// printed unescaped.
+func parseTeXTemplate(name, text string, unicodeFonts bool) (*template.Template, error) {
+	escape := texEscape
+	if unicodeFonts {
+		escape = texEscapeUnicode
+	}
+	t, err := template.New(name).Funcs(template.FuncMap{"texEscape": escape}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range t.Templates() {
+		if v.Tree != nil {
+			escapeNode(v.Tree, v.Tree.Root)
+		}
+	}
+	return t, nil
+}
+
+func escapeNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, v := range n.Nodes {
+			escapeNode(tree, v)
+		}
+	case *parse.IfNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.RangeNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.WithNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			// Assignments print nothing.
+			return
+		}
+		cmds := n.Pipe.Cmds
+		if last := cmds[len(cmds)-1]; len(last.Args) > 0 {
+			if id, ok := last.Args[0].(*parse.IdentifierNode); ok && id.Ident == "texEscape" {
+				return
+			}
+		}
+		n.Pipe.Cmds = append(cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier("texEscape").SetTree(tree).SetPos(n.Pos)},
+		})
+	}
+}
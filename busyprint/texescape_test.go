@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+// escapedMacros are the TeX commands escaping may produce, some with braces.
+var escapedMacros = func() []string {
+	result := []string{`\ucrun`}
+	for _, v := range texSpecials {
+		result = append(result, v)
+	}
+	for _, v := range texPunctuation {
+		result = append(result, v)
+	}
+	return result
+}()
+
+// checkEscaped fails if s, escaped text, has a command other than those
+// escaping produces, unbalanced braces or an unescaped special character.
+func checkEscaped(t *testing.T, input, s string) {
+	t.Helper()
+	depth := 0
+next:
+	for i := 0; i < len(s); i++ {
+		for _, v := range escapedMacros {
+			if strings.HasPrefix(s[i:], v) && strings.ContainsAny(v, `\{}`) {
+				i += len(v) - 1
+				continue next
+			}
+		}
+		switch c := s[i]; c {
+		case '\\', '%', '#', '&', '$', '^', '_':
+			t.Fatalf("escaping %q gave %q with %q at %d", input, s, c, i)
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth < 0 {
+				t.Fatalf("escaping %q gave %q with an unbalanced } at %d", input, s, i)
+			}
+		}
+	}
+	if depth != 0 {
+		t.Fatalf("escaping %q gave %q with %d unclosed braces", input, s, depth)
+	}
+}
+
+func TestEscapeTeX(t *testing.T) {
+	for _, tt := range []struct {
+		in           string
+		unicodeFonts bool
+		want         string
+	}{
+		{`50% of $x_1 & #2`, false, `50\% of \$x\_1 \& \#2`},
+		{`\input{/etc/passwd}`, false, `\textbackslash{}input\{/etc/passwd\}`},
+		{"a^b~c|<d>", false, `a\textasciicircum{}b\textasciitilde{}c\textbar{}\textless{}d\textgreater{}`},
+		{`"quoted"`, false, "{\\char`\\\"}quoted{\\char`\\\"}"},
+		{"Привет — «мир»", false, "Привет --- {\\char`\\\"}мир{\\char`\\\"}"},
+		{"Łódź Ελλάδα", false, "?ódz ??????"},
+		{"tab\tnew\nline\x00", false, "tab new line "},
+		{"bad \xff utf-8", false, "bad ? utf-8"},
+		{"Ελλάδα — 日本", true, `\ucrun{Ε}{Ελλάδα} — \ucrun{日}{日本}`},
+		{"x{日}", true, `x\{\ucrun{日}{日}\}`},
+	} {
+		got := escapeTeX(tt.in, tt.unicodeFonts)
+		if got != tt.want {
+			t.Errorf("escapeTeX(%q, %v) = %q, want %q", tt.in, tt.unicodeFonts, got, tt.want)
+		}
+		checkEscaped(t, tt.in, got)
+	}
+	if got := escapeTeX(rawTeX(`\textbf{raw}`), false); got != `\textbf{raw}` {
+		t.Errorf("escapeTeX of rawTeX = %q", got)
+	}
+	if got := escapeTeX(42, false); got != "42" {
+		t.Errorf("escapeTeX(42) = %q", got)
+	}
+}
+
+func TestEscapeTemplate(t *testing.T) {
+	const evil = `}\evil{%`
+	const evilEscaped = `\}\textbackslash{}evil\{\%`
+	data := map[string]interface{}{
+		"Name":  evil,
+		"List":  []string{evil, "ok"},
+		"Empty": []string{},
+		"Raw":   rawTeX(`\raw{}`),
+		"Job":   &tpb.PrintJob{Filename: evil},
+	}
+	for _, tt := range []struct {
+		name, text, want string
+	}{
+		{"action", `[{{.Name}}]`, `[` + evilEscaped + `]`},
+		{"method", `{{.Job.GetFilename}}`, evilEscaped},
+		{"raw", `{{.Raw}}`, `\raw{}`},
+		{"pipeline", `{{.Name | printf "%s!"}}`, evilEscaped + `!`},
+		{"explicit", `{{texEscape .Name}}|{{.Name | texEscape}}`, evilEscaped + `|` + evilEscaped},
+		{"escape first", `{{texEscape .Name | printf "\\%s"}}`, texEscape(`\` + evilEscaped)},
+		{"if", `{{if .Name}}{{.Name}}{{else}}no{{end}}`, evilEscaped},
+		{"else", `{{if .Empty}}yes{{else if .Name}}{{.Name}}{{end}}`, evilEscaped},
+		{"range", `{{range $i, $v := .List}}{{$i}}:{{$v}};{{end}}`, `0:` + evilEscaped + `;1:ok;`},
+		{"range else", `{{range .Empty}}x{{else}}{{.Name}}{{end}}`, evilEscaped},
+		{"with", `{{with .Job}}{{.GetFilename}}{{end}}`, evilEscaped},
+		{"with else", `{{with .Empty}}x{{else}}{{.Name}}{{end}}`, evilEscaped},
+		{"variable", `{{$x := .Name}}{{$x = printf "%s%s" $x "}"}}{{$x}}`, evilEscaped + `\}`},
+		{"template", `{{define "part"}}<{{.}}>{{end}}{{template "part" .Name}}`, `<` + evilEscaped + `>`},
+		{"block", `{{block "part" .Name}}({{.}}){{end}}`, `(` + evilEscaped + `)`},
+		{"nested template", `{{define "a"}}{{template "b" .}}{{end}}{{define "b"}}{{.}}{{end}}{{template "a" .Name}}`, evilEscaped},
+		{"text", `\section{ {{- .Name -}} }`, `\section{` + evilEscaped + `}`},
+	} {
+		tmpl, err := parseTeXTemplate(tt.name, tt.text, false)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+// Markers around values in rendered documents. They pass escaping unchanged,
+// and the spaces keep characters of the value from combining with them.
+const (
+	valueStart = "@@start@@ "
+	valueEnd   = " @@end@@"
+)
+
+// FuzzTexEscape checks that no string escapes into anything but text, on its
+// own and inside the built-in templates.
+func FuzzTexEscape(f *testing.F) {
+	for _, v := range []string{
+		"", "plain", `\input{/etc/passwd}`, `}{`, `%`, `#&$^_~`, `\\`, `{\char`,
+		"Привет «мир» — №1", "Łódź", "日本語 עברית 🙂", "é", "́", "\xff\xfe",
+		"a\x00b\tc\nd", `\ucrun{x}{y}`, " ", `"`,
+	} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, unicodeFonts := range []bool{false, true} {
+			checkEscaped(t, s, escapeTeX(s, unicodeFonts))
+		}
+		if strings.Contains(s, "@@") {
+			return
+		}
+
+		v := valueStart + s + valueEnd
+		data := &templateData{
+			PrintJob: &tpb.PrintJob{
+				Filename: v,
+				Contest:  &tpb.IdName{Name: v},
+				Team:     &tpb.IdName{Name: v},
+				Computer: &tpb.Computer{Id: v, Name: v},
+				Area:     &tpb.IdName{Name: v},
+			},
+			Encoding:      v,
+			MonoFont:      v,
+			FallbackFonts: []string{v, v},
+		}
+		for _, tmpl := range []struct {
+			unicodeFonts bool
+			execute      func(*bytes.Buffer) error
+		}{
+			{false, func(b *bytes.Buffer) error { return documentTemplate.Execute(b, data) }},
+			{true, func(b *bytes.Buffer) error { return unicodeTemplate.Execute(b, data) }},
+		} {
+			var out bytes.Buffer
+			if err := tmpl.execute(&out); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.TrimSuffix(strings.TrimPrefix(escapeTeX(v, tmpl.unicodeFonts), valueStart), valueEnd)
+			parts := strings.Split(out.String(), valueStart)
+			if len(parts) < 10 {
+				t.Fatalf("only %d values in the rendered document", len(parts)-1)
+			}
+			for _, part := range parts[1:] {
+				value, _, ok := strings.Cut(part, valueEnd)
+				if !ok {
+					t.Fatalf("value %q not terminated in the rendered document", part)
+				}
+				if value != want {
+					t.Fatalf("template rendered %q as %q, want %q", s, value, want)
+				}
+				checkEscaped(t, s, value)
+			}
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type jobState string
+
+const (
+	jobUnknown  jobState = ""
+	jobReceived jobState = "received"
+	jobPrinting jobState = "printing"
+	jobPrinted  jobState = "printed"
+)
+
+type jobRecord struct {
+	State    jobState  `json:"state"`
+	Pages    int64     `json:"pages,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Fallback string    `json:"fallback,omitempty"`
+	Language string    `json:"language,omitempty"`
+	Charset  string    `json:"charset,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+// jobStore remembers how far each job got, so a redelivered job is not
+// printed twice.
+type jobStore interface {
+	Get(jobID string) (jobRecord, error)
+	Put(jobID string, rec jobRecord) error
+}
+
+func newJobStore(kind, dir string, retain time.Duration) (jobStore, error) {
+	switch kind {
+	case "", "file":
+		return newFileJobStore(dir, retain)
+	case "memory":
+		return &memJobStore{jobs: make(map[string]jobRecord)}, nil
+	}
+	return nil, fmt.Errorf("unknown job store %q", kind)
+}
+
+// fileJobStore keeps one JSON file per job in a directory. Files are replaced
+// atomically and the directory is synced after, so a crash leaves either the
+// old or the new state.
+type fileJobStore struct {
+	dir string
+}
+
+func newFileJobStore(dir string, retain time.Duration) (*fileJobStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	s := &fileJobStore{dir: dir}
+	if retain > 0 {
+		s.prune(time.Now().Add(-retain))
+	}
+	return s, nil
+}
+
+func (s *fileJobStore) path(jobID string) string {
+	return filepath.Join(s.dir, url.PathEscape(jobID)+".json")
+}
+
+func (s *fileJobStore) Get(jobID string) (jobRecord, error) {
+	var rec jobRecord
+	buf, err := os.ReadFile(s.path(jobID))
+	if errors.Is(err, os.ErrNotExist) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(buf, &rec)
+	return rec, err
+}
+
+func (s *fileJobStore) Put(jobID string, rec jobRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path(jobID)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// syncDir makes renames in dir durable. Windows can't sync a directory, but
+// NTFS journals renames anyway.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (s *fileJobStore) prune(before time.Time) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Errorf("can't list job store: %v", err)
+		return
+	}
+	for _, v := range entries {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), ".json") {
+			continue
+		}
+		if info, err := v.Info(); err == nil && info.ModTime().Before(before) {
+			os.Remove(filepath.Join(s.dir, v.Name()))
+		}
+	}
+}
+
+type memJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]jobRecord
+}
+
+func (s *memJobStore) Get(jobID string) (jobRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[jobID], nil
+}
+
+func (s *memJobStore) Put(jobID string, rec jobRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[jobID] = rec
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileJobStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileJobStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, err := s.Get("a/b"); err != nil || rec.State != jobUnknown {
+		t.Errorf("Get of a new job = %+v, %v, want an empty record", rec, err)
+	}
+	want := jobRecord{State: jobPrinted, Pages: 5, Error: "jam", Fallback: "xelatex", Updated: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	if err := s.Put("a/b", jobRecord{State: jobPrinting}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("a/b", want); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := s.Get("a/b"); err != nil || rec != want {
+		t.Errorf("Get = %+v, %v, want %+v", rec, err, want)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "a%2Fb.json" {
+		t.Errorf("job store holds %v, want just a%%2Fb.json", entries)
+	}
+}
+
+func TestFileJobStorePrune(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileJobStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"old", "new"} {
+		if err := s.Put(v, jobRecord{State: jobPrinted, Pages: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(dir, "notes.txt")
+	os.WriteFile(other, nil, 0o644)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, v := range []string{s.path("old"), other} {
+		if err := os.Chtimes(v, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s, err = newFileJobStore(dir, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// A pruned job is forgotten: if it were delivered again, it would be
+	// printed again.
+	if rec, _ := s.Get("old"); rec.State != jobUnknown {
+		t.Errorf("old job is still %q after pruning", rec.State)
+	}
+	if rec, _ := s.Get("new"); rec.State != jobPrinted {
+		t.Errorf("new job is %q after pruning, want printed", rec.State)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("pruning removed a file that isn't a job record: %v", err)
+	}
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/contester/printing3/tools"
-	"github.com/go-stomp/stomp"
-	"google.golang.org/protobuf/proto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	tpb "github.com/contester/printing3/tickets"
 	log "github.com/sirupsen/logrus"
@@ -19,58 +22,188 @@ import (
 
 type server struct {
 	sconfig
+
+	jobs   jobStore
+	dryRun bool
+}
+
+func (s *server) sendReport(msg *tools.Message, report *tpb.PrintJobReport) error {
+	return tools.SendAndAck(msg, s.FailureQueue, report, tools.AsJSON(s.JSONReports))
 }
 
-func (s *server) justPrint(printerName, sourceFullName string) error {
-	cmd := exec.Command(s.Gsprint, "-printer", printerName, sourceFullName)
+func (s *server) justPrint(ctx context.Context, printerName, sourceFullName string) error {
+	cmd := exec.CommandContext(ctx, s.Gsprint, "-printer", printerName, sourceFullName)
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
 	return cmd.Run()
 }
 
-func (s *server) processIncoming(ctx context.Context, msg *stomp.Message) error {
+// spoolExtensions maps the MIME types of BinaryJob data to spool file
+// extensions. gsprint prints both.
+var spoolExtensions = map[string]string{
+	"":                       ".ps",
+	"application/postscript": ".ps",
+	"application/pdf":        ".pdf",
+}
+
+func (s *server) processIncoming(ctx context.Context, msg *tools.Message) error {
 	var job tpb.BinaryJob
-	if err := proto.Unmarshal(msg.Body, &job); err != nil {
-		log.Errorf("Received malformed job: %s", err)
-		return tools.MaybeAck(msg)
+	if err := tools.Unmarshal(msg, &job); err != nil {
+		return fmt.Errorf("received malformed job: %w", err)
+	}
+	ctx = tools.WithLogFields(ctx, log.Fields{"job_id": job.GetJobId(), "printer": job.GetPrinter(), "pages": job.GetPages(), "mime_type": job.GetMimeType()})
+	logger := tools.Log(ctx)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("job.id", job.GetJobId()), attribute.String("job.printer", job.GetPrinter()), attribute.String("job.mime_type", job.GetMimeType()))
+
+	ext, ok := spoolExtensions[job.GetMimeType()]
+	if !ok {
+		logger.Errorf("Can't print %s", job.GetMimeType())
+		msg.MarkFailed()
+		return s.sendReport(msg, &tpb.PrintJobReport{
+			JobExpandedId:    job.GetJobId(),
+			ErrorMessage:     fmt.Sprintf("can't print %s", job.GetMimeType()),
+			TimestampSeconds: time.Now().Unix(),
+		})
+	}
+
+	jobs := s.jobs
+	if job.GetJobId() == "" {
+		// Jobs without an id would share a record, and only the first would print.
+		logger.Warnf("Job has no id, printing without duplicate detection")
+		jobs = &memJobStore{jobs: make(map[string]jobRecord)}
+	}
+	rec, err := jobs.Get(job.GetJobId())
+	if err != nil {
+		return fmt.Errorf("reading job state: %w", err)
+	}
+	switch rec.State {
+	case jobPrinted:
+		logger.Infof("Job was already printed at %v, confirming", rec.Updated)
+		if rec.Error != "" {
+			msg.MarkFailed()
+		}
+		return s.sendReport(msg, &tpb.PrintJobReport{
+			JobExpandedId:    job.GetJobId(),
+			TimestampSeconds: rec.Updated.Unix(),
+			NumPages:         rec.Pages,
+			ErrorMessage:     rec.Error,
+			Fallback:         rec.Fallback,
+			Language:         rec.Language,
+			Charset:          rec.Charset,
+		})
+	case jobPrinting:
+		if !s.ReprintInterrupted {
+			logger.Warnf("Printing was interrupted at %v, not printing again", rec.Updated)
+			msg.MarkFailed()
+			return s.sendReport(msg, &tpb.PrintJobReport{
+				JobExpandedId:    job.GetJobId(),
+				TimestampSeconds: time.Now().Unix(),
+				ErrorMessage:     "printing was interrupted, check the printer before requesting a reprint",
+			})
+		}
+		logger.Warnf("Printing was interrupted at %v, printing again", rec.Updated)
+	}
+	if err := jobs.Put(job.GetJobId(), jobRecord{State: jobReceived, Updated: time.Now()}); err != nil {
+		return fmt.Errorf("recording job state: %w", err)
 	}
 
-	sourceName := time.Now().Format("2006-01-02T15-04-05") + "-" + job.GetJobId() + ".ps"
+	sourceName := time.Now().Format("2006-01-02T15-04-05") + "-" + job.GetJobId() + ext
 	sourceFullName := filepath.Join(s.Workdir, sourceName)
-	if err := os.WriteFile(sourceFullName, job.GetData(), os.ModePerm); err != nil {
-		log.Errorf("Error writing file: %s", err)
-		return tools.SendAndAck(msg, s.FailureQueue, &tpb.PrintJobReport{
+	err = tools.Traced(ctx, "write spool file", func(context.Context) error {
+		return os.WriteFile(sourceFullName, job.GetData(), os.ModePerm)
+	})
+	if err != nil {
+		logger.Errorf("Error writing file: %s", err)
+		msg.MarkFailed()
+		return s.sendReport(msg, &tpb.PrintJobReport{
 			JobExpandedId:    job.GetJobId(),
 			ErrorMessage:     err.Error(),
 			TimestampSeconds: time.Now().Unix(),
 		})
 	}
 
-	log.Infof("Sending job %s to printer %s", job.GetJobId(), job.GetPrinter())
-	var err error
-	if *dryRun {
-		log.Infof("Would run: %q %s %q %q", s.Gsprint, "-printer", job.GetPrinter(), sourceFullName)
+	// Once this is recorded, a redelivered job is never printed again unless
+	// ReprintInterrupted is set.
+	if err := jobs.Put(job.GetJobId(), jobRecord{State: jobPrinting, Updated: time.Now()}); err != nil {
+		return fmt.Errorf("recording job state: %w", err)
+	}
+
+	logger.Infof("Sending job %s to printer %s", job.GetJobId(), job.GetPrinter())
+	if s.dryRun {
+		logger.Infof("Would run: %q %s %q %q", s.Gsprint, "-printer", job.GetPrinter(), sourceFullName)
 	} else {
-		err = s.justPrint(job.GetPrinter(), sourceFullName)
+		err = tools.Traced(ctx, "print", func(ctx context.Context) error {
+			return s.justPrint(ctx, job.GetPrinter(), sourceFullName)
+		})
+	}
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by shutdown: drop the spool file. The job stays marked as
+		// printing, so the redelivery is reported instead of printed again.
+		os.Remove(sourceFullName)
+		return ctx.Err()
 	}
 
 	rpb := tpb.PrintJobReport{
 		JobExpandedId:    job.GetJobId(),
 		TimestampSeconds: time.Now().Unix(),
 		NumPages:         job.GetPages(),
+		Fallback:         job.GetFallback(),
+		Language:         job.GetLanguage(),
+		Charset:          job.GetCharset(),
 	}
 
 	if err != nil {
-		log.Errorf("Error printing: %s", err)
+		logger.Errorf("Error printing: %s", err)
 		rpb.ErrorMessage = err.Error()
+		msg.MarkFailed()
+	}
+
+	done := jobRecord{
+		State:    jobPrinted,
+		Pages:    rpb.NumPages,
+		Error:    rpb.ErrorMessage,
+		Fallback: rpb.Fallback,
+		Language: rpb.Language,
+		Charset:  rpb.Charset,
+		Updated:  time.Unix(rpb.TimestampSeconds, 0),
+	}
+	if err := jobs.Put(job.GetJobId(), done); err != nil {
+		logger.Errorf("Error recording job state: %s", err)
 	}
 
-	return tools.SendAndAck(msg, s.FailureQueue, &rpb)
+	return s.sendReport(msg, &rpb)
 }
 
 type sconfig struct {
 	Workdir, Gsprint          string
 	StompDSN                  string
 	BinaryQueue, FailureQueue string
+	DeadLetterQueue           string
+	MaxAttempts               int
+	RetryDelay, MaxRetryDelay time.Duration
+	DrainTimeout              time.Duration
+	TraceExporter             string
+	MetricsAddr               string
+	BlobStore                 string
+	Compression               []string
+	MaxDecodedSize            int
+	// RetryDelayHeader and MaxRetryWait are as in tools.RetryPolicy.
+	RetryDelayHeader string
+	MaxRetryWait     time.Duration
+	// JSONReports sends reports as JSON instead of binary protobuf.
+	JSONReports bool
+
+	// SigningKey signs the reports; if VerifyKeys is set, jobs not signed
+	// with one of them are dead-lettered instead of printed.
+	SigningKey string
+	VerifyKeys []string
+
+	// JobStore is file (default) or memory; JobStoreDir defaults to
+	// Workdir/jobs. Records older than RetainJobs are pruned on start.
+	JobStore, JobStoreDir string
+	RetainJobs            time.Duration
+	// ReprintInterrupted prints a job again if an earlier attempt was
+	// interrupted, at the risk of a duplicate.
+	ReprintInterrupted bool
 }
 
 var (
@@ -81,28 +214,68 @@ var (
 func main() {
 	flag.Parse()
 	var srv server
+	srv.dryRun = *dryRun
+	srv.MaxAttempts = 5
+	srv.RetryDelay = time.Second
+	srv.MaxRetryDelay = time.Minute
+	srv.MaxRetryWait = 5 * time.Second
+	srv.DrainTimeout = 30 * time.Second
+	srv.RetainJobs = 7 * 24 * time.Hour
+	srv.MaxDecodedSize = tools.DefaultMaxDecodedSize
 	if _, err := toml.DecodeFile(*configFile, &srv.sconfig); err != nil {
 		log.Fatal(err)
 	}
 
-	sconf, err := tools.ParseStompDSN(srv.sconfig.StompDSN)
-	if err != nil {
+	if srv.JobStoreDir == "" {
+		srv.JobStoreDir = filepath.Join(srv.Workdir, "jobs")
+	}
+	var err error
+	if srv.jobs, err = newJobStore(srv.JobStore, srv.JobStoreDir, srv.RetainJobs); err != nil {
 		log.Fatal(err)
 	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	conn, err := tools.DialStomp(ctx, sconf)
+	shutdownTracing, err := tools.InitTracing(ctx, "printagent", srv.TraceExporter)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.MustDisconnect()
+	defer shutdownTracing(context.Background())
+
+	tools.ServeMetrics(srv.MetricsAddr)
 
-	sub, err := tools.SubscribeAndProcess(ctx, conn, srv.BinaryQueue, srv.processIncoming)
+	compression, err := tools.ParseCompression(srv.Compression)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer sub.Unsubscribe()
+	compression.MaxDecodedSize = srv.MaxDecodedSize
 
-	select {}
+	tr, err := tools.OpenTransport(srv.StompDSN, srv.DrainTimeout, compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	blobs, err := tools.OpenBlobStore(srv.BlobStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	claims := tools.ClaimCheck{Store: blobs}
+	retry := tools.RetryPolicy{
+		MaxAttempts:     srv.MaxAttempts,
+		DeadLetterQueue: srv.DeadLetterQueue,
+		RetryDelay:      srv.RetryDelay,
+		MaxRetryDelay:   srv.MaxRetryDelay,
+		DelayHeader:     srv.RetryDelayHeader,
+		MaxRetryWait:    srv.MaxRetryWait,
+	}
+	signing, err := tools.NewSigning(srv.SigningKey, srv.VerifyKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(signing.Accept) == 0 {
+		log.Warnf("no verify keys configured, printing unsigned jobs")
+	}
+	tr.Subscribe(srv.BinaryQueue, 1, tools.WithStage("print", retry.Wrap(signing.Wrap(claims.Wrap(srv.processIncoming)))))
+	tr.Run(ctx)
+	log.Infof("stopped")
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/contester/printing3/tools"
+	"google.golang.org/protobuf/proto"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+func newTestServer(t *testing.T) *server {
+	return &server{
+		sconfig: sconfig{
+			Workdir:      t.TempDir(),
+			BinaryQueue:  "binary",
+			FailureQueue: "reports",
+		},
+		jobs:   &memJobStore{jobs: make(map[string]jobRecord)},
+		dryRun: true,
+	}
+}
+
+// process runs job through processIncoming and returns the report sent.
+func (s *server) process(t *testing.T, job *tpb.BinaryJob) *tpb.PrintJobReport {
+	t.Helper()
+	tr := tools.NewMemTransport()
+	tr.Subscribe(s.BinaryQueue, 1, s.processIncoming)
+	reports := make(chan *tpb.PrintJobReport, 1)
+	tr.Subscribe(s.FailureQueue, 1, func(ctx context.Context, msg *tools.Message) error {
+		var report tpb.PrintJobReport
+		if err := tools.Unmarshal(msg, &report); err != nil {
+			return err
+		}
+		reports <- &report
+		return tools.MaybeAck(msg)
+	})
+	body, err := proto.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Publish(s.BinaryQueue, &tools.Message{Body: body})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tr.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case report := <-reports:
+		return report
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report sent")
+		return nil
+	}
+}
+
+func spoolFiles(t *testing.T, s *server) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(s.Workdir, "*-job1.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestProcessIncoming(t *testing.T) {
+	earlier := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		reprint    bool
+		mimeType   string
+		rec        jobRecord
+		wantPages  int64
+		wantError  string
+		wantPrint  bool
+		wantState  jobState
+		wantUpdate bool
+	}{
+		{name: "new", wantPages: 3, wantPrint: true, wantState: jobPrinted, wantUpdate: true},
+		{name: "pdf", mimeType: "application/pdf", wantPages: 3, wantPrint: true, wantState: jobPrinted, wantUpdate: true},
+		{name: "unknown mime type", mimeType: "text/plain", wantError: "can't print text/plain", wantState: jobUnknown},
+		{name: "received", rec: jobRecord{State: jobReceived, Updated: earlier}, wantPages: 3, wantPrint: true, wantState: jobPrinted, wantUpdate: true},
+		{
+			name:      "printed",
+			rec:       jobRecord{State: jobPrinted, Pages: 2, Fallback: "xelatex", Language: "cpp (from extension), lexer C++", Charset: "utf-8 (detected)", Updated: earlier},
+			wantPages: 2, wantState: jobPrinted,
+		},
+		{
+			name:      "printed with error",
+			rec:       jobRecord{State: jobPrinted, Error: "out of paper", Updated: earlier},
+			wantError: "out of paper", wantState: jobPrinted,
+		},
+		{
+			name:      "interrupted",
+			rec:       jobRecord{State: jobPrinting, Updated: earlier},
+			wantError: "printing was interrupted", wantState: jobPrinting,
+		},
+		{
+			name: "interrupted reprint", reprint: true,
+			rec:       jobRecord{State: jobPrinting, Updated: earlier},
+			wantPages: 3, wantPrint: true, wantState: jobPrinted, wantUpdate: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.ReprintInterrupted = tt.reprint
+			if tt.rec.State != jobUnknown {
+				s.jobs.Put("job1", tt.rec)
+			}
+
+			report := s.process(t, &tpb.BinaryJob{JobId: "job1", Printer: "p1", Pages: 3, MimeType: tt.mimeType, Data: []byte("%!PS")})
+
+			if report.GetJobExpandedId() != "job1" || report.GetNumPages() != tt.wantPages || !strings.Contains(report.GetErrorMessage(), tt.wantError) || (tt.wantError == "") != (report.GetErrorMessage() == "") {
+				t.Errorf("report = %v, want %d pages and error %q", report, tt.wantPages, tt.wantError)
+			}
+			if tt.rec.State == jobPrinted && report.GetTimestampSeconds() != earlier.Unix() {
+				t.Errorf("confirmation has time %d, want the time of printing %d", report.GetTimestampSeconds(), earlier.Unix())
+			}
+			if report.GetFallback() != tt.rec.Fallback || report.GetLanguage() != tt.rec.Language || report.GetCharset() != tt.rec.Charset {
+				t.Errorf("report fallback, language and charset = %q, %q, %q, want %q, %q, %q",
+					report.GetFallback(), report.GetLanguage(), report.GetCharset(), tt.rec.Fallback, tt.rec.Language, tt.rec.Charset)
+			}
+
+			if got := spoolFiles(t, s); (len(got) == 1) != tt.wantPrint {
+				t.Errorf("spool files %q, want printed %v", got, tt.wantPrint)
+			}
+
+			rec, _ := s.jobs.Get("job1")
+			if rec.State != tt.wantState || rec.Updated.Equal(tt.rec.Updated) == tt.wantUpdate {
+				t.Errorf("job record = %+v, want state %q, updated %v", rec, tt.wantState, tt.wantUpdate)
+			}
+		})
+	}
+}
+
+// TestProcessIncomingTwice checks that a redelivered job is confirmed rather
+// than printed again.
+func TestProcessIncomingTwice(t *testing.T) {
+	s := newTestServer(t)
+	var err error
+	if s.jobs, err = newFileJobStore(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+	job := &tpb.BinaryJob{
+		JobId:    "job1",
+		Printer:  "p1",
+		Pages:    4,
+		Data:     []byte("%!PS"),
+		Fallback: "rendered with xelatex",
+		Language: "go (requested), lexer Go",
+		Charset:  "windows-1251 (detected)",
+	}
+
+	first := s.process(t, job)
+	if first.GetFallback() != job.GetFallback() || first.GetLanguage() != job.GetLanguage() || first.GetCharset() != job.GetCharset() {
+		t.Errorf("report = %v, want the fallback, language and charset of the job", first)
+	}
+	for _, v := range spoolFiles(t, s) {
+		os.Remove(v)
+	}
+	second := s.process(t, job)
+	if files := spoolFiles(t, s); len(files) != 0 {
+		t.Errorf("redelivered job was spooled again as %q", files)
+	}
+	if !proto.Equal(second, first) {
+		t.Errorf("confirmation = %v, want the same as the first report %v", second, first)
+	}
+}
+
+// TestProcessIncomingWithoutID checks that jobs without an id are all
+// printed rather than confirmed from a record they would share.
+func TestProcessIncomingWithoutID(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	var err error
+	if s.jobs, err = newFileJobStore(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		pages := int64(i + 2)
+		report := s.process(t, &tpb.BinaryJob{Printer: "p1", Pages: pages, Data: []byte("%!PS")})
+		if report.GetNumPages() != pages || report.GetErrorMessage() != "" {
+			t.Errorf("job %d: report = %v, want it printed", i, report)
+		}
+	}
+	if records, _ := filepath.Glob(filepath.Join(dir, "*")); len(records) != 0 {
+		t.Errorf("job store has %q, want no records for jobs without an id", records)
+	}
+}
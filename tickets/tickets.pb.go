@@ -35,6 +35,9 @@ type PrintJob struct {
 	Printer          string    `protobuf:"bytes,8,opt,name=printer,proto3" json:"printer,omitempty"`
 	JobId            string    `protobuf:"bytes,9,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
 	Charset          string    `protobuf:"bytes,10,opt,name=charset,proto3" json:"charset,omitempty"`
+	DataRef          *BlobRef  `protobuf:"bytes,11,opt,name=data_ref,json=dataRef,proto3" json:"data_ref,omitempty"`
+	// Language overrides the language guessed from the file name and content.
+	Language string `protobuf:"bytes,12,opt,name=language,proto3" json:"language,omitempty"`
 }
 
 func (x *PrintJob) Reset() {
@@ -139,6 +142,20 @@ func (x *PrintJob) GetCharset() string {
 	return ""
 }
 
+func (x *PrintJob) GetDataRef() *BlobRef {
+	if x != nil {
+		return x.DataRef
+	}
+	return nil
+}
+
+func (x *PrintJob) GetLanguage() string {
+	if x != nil {
+		return x.Language
+	}
+	return ""
+}
+
 type PrintJobReport struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -148,6 +165,10 @@ type PrintJobReport struct {
 	NumPages         int64  `protobuf:"varint,2,opt,name=num_pages,json=numPages,proto3" json:"num_pages,omitempty"`
 	ErrorMessage     string `protobuf:"bytes,3,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
 	TimestampSeconds int64  `protobuf:"varint,4,opt,name=timestamp_seconds,json=timestampSeconds,proto3" json:"timestamp_seconds,omitempty"`
+	// Fallback, language and charset are copied from the BinaryJob or TexJob.
+	Fallback string `protobuf:"bytes,5,opt,name=fallback,proto3" json:"fallback,omitempty"`
+	Language string `protobuf:"bytes,6,opt,name=language,proto3" json:"language,omitempty"`
+	Charset  string `protobuf:"bytes,7,opt,name=charset,proto3" json:"charset,omitempty"`
 }
 
 func (x *PrintJobReport) Reset() {
@@ -210,14 +231,47 @@ func (x *PrintJobReport) GetTimestampSeconds() int64 {
 	return 0
 }
 
+func (x *PrintJobReport) GetFallback() string {
+	if x != nil {
+		return x.Fallback
+	}
+	return ""
+}
+
+func (x *PrintJobReport) GetLanguage() string {
+	if x != nil {
+		return x.Language
+	}
+	return ""
+}
+
+func (x *PrintJobReport) GetCharset() string {
+	if x != nil {
+		return x.Charset
+	}
+	return ""
+}
+
 type TexJob struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Printer string `protobuf:"bytes,1,opt,name=printer,proto3" json:"printer,omitempty"`
-	Data    []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
-	JobId   string `protobuf:"bytes,3,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Printer string   `protobuf:"bytes,1,opt,name=printer,proto3" json:"printer,omitempty"`
+	Data    []byte   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	JobId   string   `protobuf:"bytes,3,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	DataRef *BlobRef `protobuf:"bytes,4,opt,name=data_ref,json=dataRef,proto3" json:"data_ref,omitempty"`
+	// Engine is latex, which makes PostScript, or pdflatex, xelatex or
+	// lualatex, which make PDF. If empty, busyprint picks it by printer.
+	Engine string `protobuf:"bytes,5,opt,name=engine,proto3" json:"engine,omitempty"`
+	// Fallback says why the job is rendered other than configured, if it is.
+	Fallback string `protobuf:"bytes,6,opt,name=fallback,proto3" json:"fallback,omitempty"`
+	// Language says how the source was highlighted: the language, how it was
+	// chosen and the lexer used.
+	Language string `protobuf:"bytes,7,opt,name=language,proto3" json:"language,omitempty"`
+	// Charset is the charset the source was decoded from, and whether it was
+	// detected.
+	Charset string `protobuf:"bytes,8,opt,name=charset,proto3" json:"charset,omitempty"`
 }
 
 func (x *TexJob) Reset() {
@@ -273,15 +327,56 @@ func (x *TexJob) GetJobId() string {
 	return ""
 }
 
+func (x *TexJob) GetDataRef() *BlobRef {
+	if x != nil {
+		return x.DataRef
+	}
+	return nil
+}
+
+func (x *TexJob) GetEngine() string {
+	if x != nil {
+		return x.Engine
+	}
+	return ""
+}
+
+func (x *TexJob) GetFallback() string {
+	if x != nil {
+		return x.Fallback
+	}
+	return ""
+}
+
+func (x *TexJob) GetLanguage() string {
+	if x != nil {
+		return x.Language
+	}
+	return ""
+}
+
+func (x *TexJob) GetCharset() string {
+	if x != nil {
+		return x.Charset
+	}
+	return ""
+}
+
 type BinaryJob struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Printer string `protobuf:"bytes,1,opt,name=printer,proto3" json:"printer,omitempty"`
-	Data    []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
-	JobId   string `protobuf:"bytes,3,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
-	Pages   int64  `protobuf:"varint,4,opt,name=pages,proto3" json:"pages,omitempty"`
+	Printer string   `protobuf:"bytes,1,opt,name=printer,proto3" json:"printer,omitempty"`
+	Data    []byte   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	JobId   string   `protobuf:"bytes,3,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Pages   int64    `protobuf:"varint,4,opt,name=pages,proto3" json:"pages,omitempty"`
+	DataRef *BlobRef `protobuf:"bytes,5,opt,name=data_ref,json=dataRef,proto3" json:"data_ref,omitempty"`
+	// MIME type of data: application/postscript if empty, or application/pdf.
+	MimeType string `protobuf:"bytes,6,opt,name=mime_type,json=mimeType,proto3" json:"mime_type,omitempty"`
+	Fallback string `protobuf:"bytes,7,opt,name=fallback,proto3" json:"fallback,omitempty"`
+	Language string `protobuf:"bytes,8,opt,name=language,proto3" json:"language,omitempty"`
+	Charset  string `protobuf:"bytes,9,opt,name=charset,proto3" json:"charset,omitempty"`
 }
 
 func (x *BinaryJob) Reset() {
@@ -344,6 +439,98 @@ func (x *BinaryJob) GetPages() int64 {
 	return 0
 }
 
+func (x *BinaryJob) GetDataRef() *BlobRef {
+	if x != nil {
+		return x.DataRef
+	}
+	return nil
+}
+
+func (x *BinaryJob) GetMimeType() string {
+	if x != nil {
+		return x.MimeType
+	}
+	return ""
+}
+
+func (x *BinaryJob) GetFallback() string {
+	if x != nil {
+		return x.Fallback
+	}
+	return ""
+}
+
+func (x *BinaryJob) GetLanguage() string {
+	if x != nil {
+		return x.Language
+	}
+	return ""
+}
+
+func (x *BinaryJob) GetCharset() string {
+	if x != nil {
+		return x.Charset
+	}
+	return ""
+}
+
+// BlobRef stands in for a payload moved to the blob store, which keeps it
+// under its SHA-256 digest.
+type BlobRef struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Sha256 string `protobuf:"bytes,1,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Size   int64  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+}
+
+func (x *BlobRef) Reset() {
+	*x = BlobRef{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tickets_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BlobRef) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlobRef) ProtoMessage() {}
+
+func (x *BlobRef) ProtoReflect() protoreflect.Message {
+	mi := &file_tickets_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlobRef.ProtoReflect.Descriptor instead.
+func (*BlobRef) Descriptor() ([]byte, []int) {
+	return file_tickets_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *BlobRef) GetSha256() string {
+	if x != nil {
+		return x.Sha256
+	}
+	return ""
+}
+
+func (x *BlobRef) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
 type IdName struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -356,7 +543,7 @@ type IdName struct {
 func (x *IdName) Reset() {
 	*x = IdName{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_tickets_proto_msgTypes[4]
+		mi := &file_tickets_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -369,7 +556,7 @@ func (x *IdName) String() string {
 func (*IdName) ProtoMessage() {}
 
 func (x *IdName) ProtoReflect() protoreflect.Message {
-	mi := &file_tickets_proto_msgTypes[4]
+	mi := &file_tickets_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -382,7 +569,7 @@ func (x *IdName) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use IdName.ProtoReflect.Descriptor instead.
 func (*IdName) Descriptor() ([]byte, []int) {
-	return file_tickets_proto_rawDescGZIP(), []int{4}
+	return file_tickets_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *IdName) GetId() uint32 {
@@ -411,7 +598,7 @@ type Computer struct {
 func (x *Computer) Reset() {
 	*x = Computer{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_tickets_proto_msgTypes[5]
+		mi := &file_tickets_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -424,7 +611,7 @@ func (x *Computer) String() string {
 func (*Computer) ProtoMessage() {}
 
 func (x *Computer) ProtoReflect() protoreflect.Message {
-	mi := &file_tickets_proto_msgTypes[5]
+	mi := &file_tickets_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -437,7 +624,7 @@ func (x *Computer) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Computer.ProtoReflect.Descriptor instead.
 func (*Computer) Descriptor() ([]byte, []int) {
-	return file_tickets_proto_rawDescGZIP(), []int{5}
+	return file_tickets_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *Computer) GetId() string {
@@ -473,7 +660,7 @@ type Ticket struct {
 func (x *Ticket) Reset() {
 	*x = Ticket{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_tickets_proto_msgTypes[6]
+		mi := &file_tickets_proto_msgTypes[7]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -486,7 +673,7 @@ func (x *Ticket) String() string {
 func (*Ticket) ProtoMessage() {}
 
 func (x *Ticket) ProtoReflect() protoreflect.Message {
-	mi := &file_tickets_proto_msgTypes[6]
+	mi := &file_tickets_proto_msgTypes[7]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -499,7 +686,7 @@ func (x *Ticket) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Ticket.ProtoReflect.Descriptor instead.
 func (*Ticket) Descriptor() ([]byte, []int) {
-	return file_tickets_proto_rawDescGZIP(), []int{6}
+	return file_tickets_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *Ticket) GetContest() *IdName {
@@ -580,7 +767,7 @@ type Ticket_Submit struct {
 func (x *Ticket_Submit) Reset() {
 	*x = Ticket_Submit{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_tickets_proto_msgTypes[7]
+		mi := &file_tickets_proto_msgTypes[8]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -593,7 +780,7 @@ func (x *Ticket_Submit) String() string {
 func (*Ticket_Submit) ProtoMessage() {}
 
 func (x *Ticket_Submit) ProtoReflect() protoreflect.Message {
-	mi := &file_tickets_proto_msgTypes[7]
+	mi := &file_tickets_proto_msgTypes[8]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -606,7 +793,7 @@ func (x *Ticket_Submit) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Ticket_Submit.ProtoReflect.Descriptor instead.
 func (*Ticket_Submit) Descriptor() ([]byte, []int) {
-	return file_tickets_proto_rawDescGZIP(), []int{6, 0}
+	return file_tickets_proto_rawDescGZIP(), []int{7, 0}
 }
 
 func (x *Ticket_Submit) GetSubmitNumber() uint32 {
@@ -656,7 +843,7 @@ type Ticket_Problem struct {
 func (x *Ticket_Problem) Reset() {
 	*x = Ticket_Problem{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_tickets_proto_msgTypes[8]
+		mi := &file_tickets_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -669,7 +856,7 @@ func (x *Ticket_Problem) String() string {
 func (*Ticket_Problem) ProtoMessage() {}
 
 func (x *Ticket_Problem) ProtoReflect() protoreflect.Message {
-	mi := &file_tickets_proto_msgTypes[8]
+	mi := &file_tickets_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -682,7 +869,7 @@ func (x *Ticket_Problem) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Ticket_Problem.ProtoReflect.Descriptor instead.
 func (*Ticket_Problem) Descriptor() ([]byte, []int) {
-	return file_tickets_proto_rawDescGZIP(), []int{6, 1}
+	return file_tickets_proto_rawDescGZIP(), []int{7, 1}
 }
 
 func (x *Ticket_Problem) GetId() string {
@@ -711,7 +898,7 @@ type Ticket_Submit_School struct {
 func (x *Ticket_Submit_School) Reset() {
 	*x = Ticket_Submit_School{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_tickets_proto_msgTypes[9]
+		mi := &file_tickets_proto_msgTypes[10]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -724,7 +911,7 @@ func (x *Ticket_Submit_School) String() string {
 func (*Ticket_Submit_School) ProtoMessage() {}
 
 func (x *Ticket_Submit_School) ProtoReflect() protoreflect.Message {
-	mi := &file_tickets_proto_msgTypes[9]
+	mi := &file_tickets_proto_msgTypes[10]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -737,7 +924,7 @@ func (x *Ticket_Submit_School) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Ticket_Submit_School.ProtoReflect.Descriptor instead.
 func (*Ticket_Submit_School) Descriptor() ([]byte, []int) {
-	return file_tickets_proto_rawDescGZIP(), []int{6, 0, 0}
+	return file_tickets_proto_rawDescGZIP(), []int{7, 0, 0}
 }
 
 func (x *Ticket_Submit_School) GetTestsTaken() uint32 {
@@ -766,7 +953,7 @@ type Ticket_Submit_ACM struct {
 func (x *Ticket_Submit_ACM) Reset() {
 	*x = Ticket_Submit_ACM{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_tickets_proto_msgTypes[10]
+		mi := &file_tickets_proto_msgTypes[11]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -779,7 +966,7 @@ func (x *Ticket_Submit_ACM) String() string {
 func (*Ticket_Submit_ACM) ProtoMessage() {}
 
 func (x *Ticket_Submit_ACM) ProtoReflect() protoreflect.Message {
-	mi := &file_tickets_proto_msgTypes[10]
+	mi := &file_tickets_proto_msgTypes[11]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -792,7 +979,7 @@ func (x *Ticket_Submit_ACM) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Ticket_Submit_ACM.ProtoReflect.Descriptor instead.
 func (*Ticket_Submit_ACM) Descriptor() ([]byte, []int) {
-	return file_tickets_proto_rawDescGZIP(), []int{6, 0, 1}
+	return file_tickets_proto_rawDescGZIP(), []int{7, 0, 1}
 }
 
 func (x *Ticket_Submit_ACM) GetResult() string {
@@ -813,7 +1000,7 @@ var File_tickets_proto protoreflect.FileDescriptor
 
 var file_tickets_proto_rawDesc = []byte{
 	0x0a, 0x0d, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
-	0x07, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x22, 0xd6, 0x02, 0x0a, 0x08, 0x50, 0x72, 0x69,
+	0x07, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x22, 0x9f, 0x03, 0x0a, 0x08, 0x50, 0x72, 0x69,
 	0x6e, 0x74, 0x4a, 0x6f, 0x62, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d,
 	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d,
 	0x65, 0x12, 0x29, 0x0a, 0x07, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x73, 0x74, 0x18, 0x02, 0x20, 0x01,
@@ -835,84 +1022,117 @@ var file_tickets_proto_rawDesc = []byte{
 	0x12, 0x15, 0x0a, 0x06, 0x6a, 0x6f, 0x62, 0x5f, 0x69, 0x64, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09,
 	0x52, 0x05, 0x6a, 0x6f, 0x62, 0x49, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x72, 0x73,
 	0x65, 0x74, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63, 0x68, 0x61, 0x72, 0x73, 0x65,
-	0x74, 0x22, 0xa7, 0x01, 0x0a, 0x0e, 0x50, 0x72, 0x69, 0x6e, 0x74, 0x4a, 0x6f, 0x62, 0x52, 0x65,
-	0x70, 0x6f, 0x72, 0x74, 0x12, 0x26, 0x0a, 0x0f, 0x6a, 0x6f, 0x62, 0x5f, 0x65, 0x78, 0x70, 0x61,
-	0x6e, 0x64, 0x65, 0x64, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x6a,
-	0x6f, 0x62, 0x45, 0x78, 0x70, 0x61, 0x6e, 0x64, 0x65, 0x64, 0x49, 0x64, 0x12, 0x1b, 0x0a, 0x09,
-	0x6e, 0x75, 0x6d, 0x5f, 0x70, 0x61, 0x67, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52,
-	0x08, 0x6e, 0x75, 0x6d, 0x50, 0x61, 0x67, 0x65, 0x73, 0x12, 0x23, 0x0a, 0x0d, 0x65, 0x72, 0x72,
-	0x6f, 0x72, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x0c, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x2b,
-	0x0a, 0x11, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x5f, 0x73, 0x65, 0x63, 0x6f,
-	0x6e, 0x64, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x10, 0x74, 0x69, 0x6d, 0x65, 0x73,
-	0x74, 0x61, 0x6d, 0x70, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x22, 0x4d, 0x0a, 0x06, 0x54,
-	0x65, 0x78, 0x4a, 0x6f, 0x62, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72,
-	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x12,
-	0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64,
-	0x61, 0x74, 0x61, 0x12, 0x15, 0x0a, 0x06, 0x6a, 0x6f, 0x62, 0x5f, 0x69, 0x64, 0x18, 0x03, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x05, 0x6a, 0x6f, 0x62, 0x49, 0x64, 0x22, 0x66, 0x0a, 0x09, 0x42, 0x69,
-	0x6e, 0x61, 0x72, 0x79, 0x4a, 0x6f, 0x62, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74,
-	0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65,
-	0x72, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52,
-	0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x15, 0x0a, 0x06, 0x6a, 0x6f, 0x62, 0x5f, 0x69, 0x64, 0x18,
-	0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6a, 0x6f, 0x62, 0x49, 0x64, 0x12, 0x14, 0x0a, 0x05,
-	0x70, 0x61, 0x67, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x70, 0x61, 0x67,
-	0x65, 0x73, 0x22, 0x2c, 0x0a, 0x06, 0x49, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x0e, 0x0a, 0x02,
-	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04,
-	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65,
-	0x22, 0x2e, 0x0a, 0x08, 0x43, 0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x72, 0x12, 0x0e, 0x0a, 0x02,
-	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04,
-	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65,
-	0x22, 0xe5, 0x05, 0x0a, 0x06, 0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x29, 0x0a, 0x07, 0x63,
-	0x6f, 0x6e, 0x74, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x74,
-	0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x49, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x52, 0x07, 0x63,
-	0x6f, 0x6e, 0x74, 0x65, 0x73, 0x74, 0x12, 0x23, 0x0a, 0x04, 0x74, 0x65, 0x61, 0x6d, 0x18, 0x02,
-	0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x49,
-	0x64, 0x4e, 0x61, 0x6d, 0x65, 0x52, 0x04, 0x74, 0x65, 0x61, 0x6d, 0x12, 0x23, 0x0a, 0x04, 0x61,
-	0x72, 0x65, 0x61, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x74, 0x69, 0x63, 0x6b,
-	0x65, 0x74, 0x73, 0x2e, 0x49, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x52, 0x04, 0x61, 0x72, 0x65, 0x61,
-	0x12, 0x2d, 0x0a, 0x08, 0x63, 0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01,
-	0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x43, 0x6f, 0x6d,
-	0x70, 0x75, 0x74, 0x65, 0x72, 0x52, 0x08, 0x63, 0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x72, 0x12,
-	0x31, 0x0a, 0x07, 0x70, 0x72, 0x6f, 0x62, 0x6c, 0x65, 0x6d, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b,
-	0x32, 0x17, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x54, 0x69, 0x63, 0x6b, 0x65,
-	0x74, 0x2e, 0x50, 0x72, 0x6f, 0x62, 0x6c, 0x65, 0x6d, 0x52, 0x07, 0x70, 0x72, 0x6f, 0x62, 0x6c,
-	0x65, 0x6d, 0x12, 0x1b, 0x0a, 0x09, 0x73, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x5f, 0x69, 0x64, 0x18,
-	0x06, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x73, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x49, 0x64, 0x12,
-	0x1d, 0x0a, 0x0a, 0x6a, 0x75, 0x64, 0x67, 0x65, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x07, 0x20,
-	0x01, 0x28, 0x04, 0x52, 0x09, 0x6a, 0x75, 0x64, 0x67, 0x65, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x2e,
-	0x0a, 0x06, 0x73, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x18, 0x08, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16,
-	0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x2e,
-	0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x52, 0x06, 0x73, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x12, 0x18,
-	0x0a, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x1a, 0xce, 0x02, 0x0a, 0x06, 0x53, 0x75, 0x62,
-	0x6d, 0x69, 0x74, 0x12, 0x23, 0x0a, 0x0d, 0x73, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x5f, 0x6e, 0x75,
-	0x6d, 0x62, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0c, 0x73, 0x75, 0x62, 0x6d,
-	0x69, 0x74, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x72, 0x72, 0x69,
-	0x76, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x07, 0x61, 0x72, 0x72, 0x69, 0x76,
-	0x65, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6f, 0x6d, 0x70, 0x69, 0x6c, 0x65, 0x64, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x63, 0x6f, 0x6d, 0x70, 0x69, 0x6c, 0x65, 0x64, 0x12, 0x35,
-	0x0a, 0x06, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d,
-	0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x2e,
-	0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x2e, 0x53, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x52, 0x06, 0x73,
-	0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x12, 0x2c, 0x0a, 0x03, 0x61, 0x63, 0x6d, 0x18, 0x05, 0x20, 0x01,
-	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x54, 0x69, 0x63,
-	0x6b, 0x65, 0x74, 0x2e, 0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x2e, 0x41, 0x43, 0x4d, 0x52, 0x03,
-	0x61, 0x63, 0x6d, 0x1a, 0x4c, 0x0a, 0x06, 0x53, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x12, 0x1f, 0x0a,
-	0x0b, 0x74, 0x65, 0x73, 0x74, 0x73, 0x5f, 0x74, 0x61, 0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01,
-	0x28, 0x0d, 0x52, 0x0a, 0x74, 0x65, 0x73, 0x74, 0x73, 0x54, 0x61, 0x6b, 0x65, 0x6e, 0x12, 0x21,
-	0x0a, 0x0c, 0x74, 0x65, 0x73, 0x74, 0x73, 0x5f, 0x70, 0x61, 0x73, 0x73, 0x65, 0x64, 0x18, 0x02,
-	0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x74, 0x65, 0x73, 0x74, 0x73, 0x50, 0x61, 0x73, 0x73, 0x65,
-	0x64, 0x1a, 0x36, 0x0a, 0x03, 0x41, 0x43, 0x4d, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75,
-	0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
-	0x12, 0x17, 0x0a, 0x07, 0x74, 0x65, 0x73, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x0d, 0x52, 0x06, 0x74, 0x65, 0x73, 0x74, 0x49, 0x64, 0x1a, 0x2d, 0x0a, 0x07, 0x50, 0x72, 0x6f,
-	0x62, 0x6c, 0x65, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x42, 0x28, 0x5a, 0x26, 0x67, 0x69, 0x74, 0x68,
-	0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x73, 0x74, 0x65, 0x72,
-	0x2f, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x69, 0x6e, 0x67, 0x33, 0x2f, 0x74, 0x69, 0x63, 0x6b, 0x65,
-	0x74, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x74, 0x12, 0x2b, 0x0a, 0x08, 0x64, 0x61, 0x74, 0x61, 0x5f, 0x72, 0x65, 0x66, 0x18, 0x0b, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x42, 0x6c,
+	0x6f, 0x62, 0x52, 0x65, 0x66, 0x52, 0x07, 0x64, 0x61, 0x74, 0x61, 0x52, 0x65, 0x66, 0x12, 0x1a,
+	0x0a, 0x08, 0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x08, 0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x22, 0xf9, 0x01, 0x0a, 0x0e, 0x50,
+	0x72, 0x69, 0x6e, 0x74, 0x4a, 0x6f, 0x62, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x26, 0x0a,
+	0x0f, 0x6a, 0x6f, 0x62, 0x5f, 0x65, 0x78, 0x70, 0x61, 0x6e, 0x64, 0x65, 0x64, 0x5f, 0x69, 0x64,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x6a, 0x6f, 0x62, 0x45, 0x78, 0x70, 0x61, 0x6e,
+	0x64, 0x65, 0x64, 0x49, 0x64, 0x12, 0x1b, 0x0a, 0x09, 0x6e, 0x75, 0x6d, 0x5f, 0x70, 0x61, 0x67,
+	0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x6e, 0x75, 0x6d, 0x50, 0x61, 0x67,
+	0x65, 0x73, 0x12, 0x23, 0x0a, 0x0d, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x5f, 0x6d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x65, 0x72, 0x72, 0x6f, 0x72,
+	0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x2b, 0x0a, 0x11, 0x74, 0x69, 0x6d, 0x65, 0x73,
+	0x74, 0x61, 0x6d, 0x70, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x10, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x53, 0x65, 0x63,
+	0x6f, 0x6e, 0x64, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x61, 0x6c, 0x6c, 0x62, 0x61, 0x63, 0x6b,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x61, 0x6c, 0x6c, 0x62, 0x61, 0x63, 0x6b,
+	0x12, 0x1a, 0x0a, 0x08, 0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x08, 0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x12, 0x18, 0x0a, 0x07,
+	0x63, 0x68, 0x61, 0x72, 0x73, 0x65, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63,
+	0x68, 0x61, 0x72, 0x73, 0x65, 0x74, 0x22, 0xe4, 0x01, 0x0a, 0x06, 0x54, 0x65, 0x78, 0x4a, 0x6f,
+	0x62, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x64,
+	0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12,
+	0x15, 0x0a, 0x06, 0x6a, 0x6f, 0x62, 0x5f, 0x69, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x6a, 0x6f, 0x62, 0x49, 0x64, 0x12, 0x2b, 0x0a, 0x08, 0x64, 0x61, 0x74, 0x61, 0x5f, 0x72,
+	0x65, 0x66, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65,
+	0x74, 0x73, 0x2e, 0x42, 0x6c, 0x6f, 0x62, 0x52, 0x65, 0x66, 0x52, 0x07, 0x64, 0x61, 0x74, 0x61,
+	0x52, 0x65, 0x66, 0x12, 0x16, 0x0a, 0x06, 0x65, 0x6e, 0x67, 0x69, 0x6e, 0x65, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x65, 0x6e, 0x67, 0x69, 0x6e, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x66,
+	0x61, 0x6c, 0x6c, 0x62, 0x61, 0x63, 0x6b, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66,
+	0x61, 0x6c, 0x6c, 0x62, 0x61, 0x63, 0x6b, 0x12, 0x1a, 0x0a, 0x08, 0x6c, 0x61, 0x6e, 0x67, 0x75,
+	0x61, 0x67, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6c, 0x61, 0x6e, 0x67, 0x75,
+	0x61, 0x67, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x72, 0x73, 0x65, 0x74, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63, 0x68, 0x61, 0x72, 0x73, 0x65, 0x74, 0x22, 0x82, 0x02,
+	0x0a, 0x09, 0x42, 0x69, 0x6e, 0x61, 0x72, 0x79, 0x4a, 0x6f, 0x62, 0x12, 0x18, 0x0a, 0x07, 0x70,
+	0x72, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x72,
+	0x69, 0x6e, 0x74, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x15, 0x0a, 0x06, 0x6a, 0x6f, 0x62,
+	0x5f, 0x69, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6a, 0x6f, 0x62, 0x49, 0x64,
+	0x12, 0x14, 0x0a, 0x05, 0x70, 0x61, 0x67, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x05, 0x70, 0x61, 0x67, 0x65, 0x73, 0x12, 0x2b, 0x0a, 0x08, 0x64, 0x61, 0x74, 0x61, 0x5f, 0x72,
+	0x65, 0x66, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65,
+	0x74, 0x73, 0x2e, 0x42, 0x6c, 0x6f, 0x62, 0x52, 0x65, 0x66, 0x52, 0x07, 0x64, 0x61, 0x74, 0x61,
+	0x52, 0x65, 0x66, 0x12, 0x1b, 0x0a, 0x09, 0x6d, 0x69, 0x6d, 0x65, 0x5f, 0x74, 0x79, 0x70, 0x65,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6d, 0x69, 0x6d, 0x65, 0x54, 0x79, 0x70, 0x65,
+	0x12, 0x1a, 0x0a, 0x08, 0x66, 0x61, 0x6c, 0x6c, 0x62, 0x61, 0x63, 0x6b, 0x18, 0x07, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x08, 0x66, 0x61, 0x6c, 0x6c, 0x62, 0x61, 0x63, 0x6b, 0x12, 0x1a, 0x0a, 0x08,
+	0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x72,
+	0x73, 0x65, 0x74, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63, 0x68, 0x61, 0x72, 0x73,
+	0x65, 0x74, 0x22, 0x35, 0x0a, 0x07, 0x42, 0x6c, 0x6f, 0x62, 0x52, 0x65, 0x66, 0x12, 0x16, 0x0a,
+	0x06, 0x73, 0x68, 0x61, 0x32, 0x35, 0x36, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73,
+	0x68, 0x61, 0x32, 0x35, 0x36, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x22, 0x2c, 0x0a, 0x06, 0x49, 0x64, 0x4e,
+	0x61, 0x6d, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0x2e, 0x0a, 0x08, 0x43, 0x6f, 0x6d, 0x70, 0x75,
+	0x74, 0x65, 0x72, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0xe5, 0x05, 0x0a, 0x06, 0x54, 0x69, 0x63, 0x6b,
+	0x65, 0x74, 0x12, 0x29, 0x0a, 0x07, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x49, 0x64,
+	0x4e, 0x61, 0x6d, 0x65, 0x52, 0x07, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x73, 0x74, 0x12, 0x23, 0x0a,
+	0x04, 0x74, 0x65, 0x61, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x74, 0x69,
+	0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x49, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x52, 0x04, 0x74, 0x65,
+	0x61, 0x6d, 0x12, 0x23, 0x0a, 0x04, 0x61, 0x72, 0x65, 0x61, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x0f, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e, 0x49, 0x64, 0x4e, 0x61, 0x6d,
+	0x65, 0x52, 0x04, 0x61, 0x72, 0x65, 0x61, 0x12, 0x2d, 0x0a, 0x08, 0x63, 0x6f, 0x6d, 0x70, 0x75,
+	0x74, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74, 0x69, 0x63, 0x6b,
+	0x65, 0x74, 0x73, 0x2e, 0x43, 0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x72, 0x52, 0x08, 0x63, 0x6f,
+	0x6d, 0x70, 0x75, 0x74, 0x65, 0x72, 0x12, 0x31, 0x0a, 0x07, 0x70, 0x72, 0x6f, 0x62, 0x6c, 0x65,
+	0x6d, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74,
+	0x73, 0x2e, 0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x2e, 0x50, 0x72, 0x6f, 0x62, 0x6c, 0x65, 0x6d,
+	0x52, 0x07, 0x70, 0x72, 0x6f, 0x62, 0x6c, 0x65, 0x6d, 0x12, 0x1b, 0x0a, 0x09, 0x73, 0x75, 0x62,
+	0x6d, 0x69, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x73, 0x75,
+	0x62, 0x6d, 0x69, 0x74, 0x49, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x6a, 0x75, 0x64, 0x67, 0x65, 0x5f,
+	0x74, 0x69, 0x6d, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x6a, 0x75, 0x64, 0x67,
+	0x65, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x2e, 0x0a, 0x06, 0x73, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x18,
+	0x08, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e,
+	0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x2e, 0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x52, 0x06, 0x73,
+	0x75, 0x62, 0x6d, 0x69, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72,
+	0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x1a,
+	0xce, 0x02, 0x0a, 0x06, 0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x12, 0x23, 0x0a, 0x0d, 0x73, 0x75,
+	0x62, 0x6d, 0x69, 0x74, 0x5f, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x0c, 0x73, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12,
+	0x18, 0x0a, 0x07, 0x61, 0x72, 0x72, 0x69, 0x76, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x07, 0x61, 0x72, 0x72, 0x69, 0x76, 0x65, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6f, 0x6d,
+	0x70, 0x69, 0x6c, 0x65, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x63, 0x6f, 0x6d,
+	0x70, 0x69, 0x6c, 0x65, 0x64, 0x12, 0x35, 0x0a, 0x06, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x2e,
+	0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x2e, 0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x2e, 0x53, 0x63,
+	0x68, 0x6f, 0x6f, 0x6c, 0x52, 0x06, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x12, 0x2c, 0x0a, 0x03,
+	0x61, 0x63, 0x6d, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x69, 0x63, 0x6b,
+	0x65, 0x74, 0x73, 0x2e, 0x54, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x2e, 0x53, 0x75, 0x62, 0x6d, 0x69,
+	0x74, 0x2e, 0x41, 0x43, 0x4d, 0x52, 0x03, 0x61, 0x63, 0x6d, 0x1a, 0x4c, 0x0a, 0x06, 0x53, 0x63,
+	0x68, 0x6f, 0x6f, 0x6c, 0x12, 0x1f, 0x0a, 0x0b, 0x74, 0x65, 0x73, 0x74, 0x73, 0x5f, 0x74, 0x61,
+	0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0a, 0x74, 0x65, 0x73, 0x74, 0x73,
+	0x54, 0x61, 0x6b, 0x65, 0x6e, 0x12, 0x21, 0x0a, 0x0c, 0x74, 0x65, 0x73, 0x74, 0x73, 0x5f, 0x70,
+	0x61, 0x73, 0x73, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x74, 0x65, 0x73,
+	0x74, 0x73, 0x50, 0x61, 0x73, 0x73, 0x65, 0x64, 0x1a, 0x36, 0x0a, 0x03, 0x41, 0x43, 0x4d, 0x12,
+	0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x17, 0x0a, 0x07, 0x74, 0x65, 0x73, 0x74, 0x5f,
+	0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x74, 0x65, 0x73, 0x74, 0x49, 0x64,
+	0x1a, 0x2d, 0x0a, 0x07, 0x50, 0x72, 0x6f, 0x62, 0x6c, 0x65, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x69,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e,
+	0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x42,
+	0x28, 0x5a, 0x26, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x6f,
+	0x6e, 0x74, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2f, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x69, 0x6e, 0x67,
+	0x33, 0x2f, 0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x33,
 }
 
 var (
@@ -927,38 +1147,42 @@ func file_tickets_proto_rawDescGZIP() []byte {
 	return file_tickets_proto_rawDescData
 }
 
-var file_tickets_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_tickets_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
 var file_tickets_proto_goTypes = []interface{}{
 	(*PrintJob)(nil),             // 0: tickets.PrintJob
 	(*PrintJobReport)(nil),       // 1: tickets.PrintJobReport
 	(*TexJob)(nil),               // 2: tickets.TexJob
 	(*BinaryJob)(nil),            // 3: tickets.BinaryJob
-	(*IdName)(nil),               // 4: tickets.IdName
-	(*Computer)(nil),             // 5: tickets.Computer
-	(*Ticket)(nil),               // 6: tickets.Ticket
-	(*Ticket_Submit)(nil),        // 7: tickets.Ticket.Submit
-	(*Ticket_Problem)(nil),       // 8: tickets.Ticket.Problem
-	(*Ticket_Submit_School)(nil), // 9: tickets.Ticket.Submit.School
-	(*Ticket_Submit_ACM)(nil),    // 10: tickets.Ticket.Submit.ACM
+	(*BlobRef)(nil),              // 4: tickets.BlobRef
+	(*IdName)(nil),               // 5: tickets.IdName
+	(*Computer)(nil),             // 6: tickets.Computer
+	(*Ticket)(nil),               // 7: tickets.Ticket
+	(*Ticket_Submit)(nil),        // 8: tickets.Ticket.Submit
+	(*Ticket_Problem)(nil),       // 9: tickets.Ticket.Problem
+	(*Ticket_Submit_School)(nil), // 10: tickets.Ticket.Submit.School
+	(*Ticket_Submit_ACM)(nil),    // 11: tickets.Ticket.Submit.ACM
 }
 var file_tickets_proto_depIdxs = []int32{
-	4,  // 0: tickets.PrintJob.contest:type_name -> tickets.IdName
-	4,  // 1: tickets.PrintJob.team:type_name -> tickets.IdName
-	5,  // 2: tickets.PrintJob.computer:type_name -> tickets.Computer
-	4,  // 3: tickets.PrintJob.area:type_name -> tickets.IdName
-	4,  // 4: tickets.Ticket.contest:type_name -> tickets.IdName
-	4,  // 5: tickets.Ticket.team:type_name -> tickets.IdName
-	4,  // 6: tickets.Ticket.area:type_name -> tickets.IdName
-	5,  // 7: tickets.Ticket.computer:type_name -> tickets.Computer
-	8,  // 8: tickets.Ticket.problem:type_name -> tickets.Ticket.Problem
-	7,  // 9: tickets.Ticket.submit:type_name -> tickets.Ticket.Submit
-	9,  // 10: tickets.Ticket.Submit.school:type_name -> tickets.Ticket.Submit.School
-	10, // 11: tickets.Ticket.Submit.acm:type_name -> tickets.Ticket.Submit.ACM
-	12, // [12:12] is the sub-list for method output_type
-	12, // [12:12] is the sub-list for method input_type
-	12, // [12:12] is the sub-list for extension type_name
-	12, // [12:12] is the sub-list for extension extendee
-	0,  // [0:12] is the sub-list for field type_name
+	5,  // 0: tickets.PrintJob.contest:type_name -> tickets.IdName
+	5,  // 1: tickets.PrintJob.team:type_name -> tickets.IdName
+	6,  // 2: tickets.PrintJob.computer:type_name -> tickets.Computer
+	5,  // 3: tickets.PrintJob.area:type_name -> tickets.IdName
+	4,  // 4: tickets.PrintJob.data_ref:type_name -> tickets.BlobRef
+	4,  // 5: tickets.TexJob.data_ref:type_name -> tickets.BlobRef
+	4,  // 6: tickets.BinaryJob.data_ref:type_name -> tickets.BlobRef
+	5,  // 7: tickets.Ticket.contest:type_name -> tickets.IdName
+	5,  // 8: tickets.Ticket.team:type_name -> tickets.IdName
+	5,  // 9: tickets.Ticket.area:type_name -> tickets.IdName
+	6,  // 10: tickets.Ticket.computer:type_name -> tickets.Computer
+	9,  // 11: tickets.Ticket.problem:type_name -> tickets.Ticket.Problem
+	8,  // 12: tickets.Ticket.submit:type_name -> tickets.Ticket.Submit
+	10, // 13: tickets.Ticket.Submit.school:type_name -> tickets.Ticket.Submit.School
+	11, // 14: tickets.Ticket.Submit.acm:type_name -> tickets.Ticket.Submit.ACM
+	15, // [15:15] is the sub-list for method output_type
+	15, // [15:15] is the sub-list for method input_type
+	15, // [15:15] is the sub-list for extension type_name
+	15, // [15:15] is the sub-list for extension extendee
+	0,  // [0:15] is the sub-list for field type_name
 }
 
 func init() { file_tickets_proto_init() }
@@ -1016,7 +1240,7 @@ func file_tickets_proto_init() {
 			}
 		}
 		file_tickets_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*IdName); i {
+			switch v := v.(*BlobRef); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1028,7 +1252,7 @@ func file_tickets_proto_init() {
 			}
 		}
 		file_tickets_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Computer); i {
+			switch v := v.(*IdName); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1040,7 +1264,7 @@ func file_tickets_proto_init() {
 			}
 		}
 		file_tickets_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Ticket); i {
+			switch v := v.(*Computer); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1052,7 +1276,7 @@ func file_tickets_proto_init() {
 			}
 		}
 		file_tickets_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Ticket_Submit); i {
+			switch v := v.(*Ticket); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1064,7 +1288,7 @@ func file_tickets_proto_init() {
 			}
 		}
 		file_tickets_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Ticket_Problem); i {
+			switch v := v.(*Ticket_Submit); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1076,7 +1300,7 @@ func file_tickets_proto_init() {
 			}
 		}
 		file_tickets_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Ticket_Submit_School); i {
+			switch v := v.(*Ticket_Problem); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1088,6 +1312,18 @@ func file_tickets_proto_init() {
 			}
 		}
 		file_tickets_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Ticket_Submit_School); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tickets_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Ticket_Submit_ACM); i {
 			case 0:
 				return &v.state
@@ -1106,7 +1342,7 @@ func file_tickets_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_tickets_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   11,
+			NumMessages:   12,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
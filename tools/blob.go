@@ -0,0 +1,355 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for keys that were never stored
+// or have expired.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps job payloads too large to travel through the broker.
+// Keys are hex SHA-256 digests of the content, so storing the same payload
+// twice is harmless. Stores never delete blobs by themselves, see
+// OpenBlobStore for expiring them.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// ValidBlobKey reports whether key is a lowercase hex SHA-256 digest. Keys
+// come from messages, so stores check them before building paths.
+func ValidBlobKey(key string) bool {
+	if len(key) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range []byte(key) {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func checkBlobKey(key string) error {
+	if !ValidBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+// OpenBlobStore opens the store described by dsn:
+//
+//	/var/spool/printing/blobs                      local directory
+//	file:///var/spool/printing/blobs               same
+//	s3://host:port/bucket/prefix?region=us-east-1  S3-compatible service over https
+//	s3+http://host:port/bucket/prefix              same over plain http
+//
+// S3 credentials are taken from the dsn user info or from AWS_ACCESS_KEY_ID
+// and AWS_SECRET_ACCESS_KEY. An empty dsn returns a nil store.
+//
+// Blobs are kept until something deletes them. A local directory given as
+// file:///var/spool/printing/blobs?retain=168h is pruned of blobs not stored
+// for the given time when opened; S3 buckets need a lifecycle rule instead.
+// Either way, keep blobs longer than jobs may wait in queues.
+func OpenBlobStore(dsn string) (BlobStore, error) {
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse blob store %q: %w", dsn, err)
+	}
+	switch u.Scheme {
+	case "", "file":
+		s, err := NewDirBlobStore(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		if v := u.Query().Get("retain"); v != "" {
+			retain, err := time.ParseDuration(v)
+			if err != nil || retain <= 0 {
+				return nil, fmt.Errorf("invalid blob retention %q", v)
+			}
+			s.Prune(time.Now().Add(-retain))
+		}
+		return s, nil
+	case "s3", "s3+http":
+		return newS3BlobStore(u)
+	}
+	return nil, fmt.Errorf("unknown blob store scheme %q", u.Scheme)
+}
+
+// DirBlobStore keeps blobs as files in a local directory, fanned out by the
+// first two characters of the key. It also stands in for S3 on a single box
+// or a shared filesystem.
+type DirBlobStore struct {
+	dir string
+}
+
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("blob store directory is not set")
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &DirBlobStore{dir: dir}, nil
+}
+
+func (s *DirBlobStore) path(key string) (string, error) {
+	if err := checkBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+func (s *DirBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(name); err == nil {
+		// Stored again: restart its retention.
+		now := time.Now()
+		return os.Chtimes(name, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (s *DirBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	return data, err
+}
+
+// Prune deletes blobs last stored before the given time.
+func (s *DirBlobStore) Prune(before time.Time) {
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Errorf("can't list blob store: %v", err)
+		return
+	}
+	var pruned int
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.dir, d.Name()))
+		if err != nil {
+			log.Errorf("can't list blob store: %v", err)
+			continue
+		}
+		for _, v := range entries {
+			if !ValidBlobKey(v.Name()) {
+				continue
+			}
+			if info, err := v.Info(); err == nil && info.ModTime().Before(before) {
+				if os.Remove(filepath.Join(s.dir, d.Name(), v.Name())) == nil {
+					pruned++
+				}
+			}
+		}
+	}
+	if pruned > 0 {
+		log.Infof("pruned %d blob(s) stored before %v", pruned, before)
+	}
+}
+
+// s3BlobStore talks to an S3-compatible service using path-style requests
+// signed with AWS Signature Version 4.
+type s3BlobStore struct {
+	endpoint, bucket, prefix string
+	region                   string
+	accessKey, secretKey     string
+	client                   *http.Client
+}
+
+func newS3BlobStore(u *url.URL) (*s3BlobStore, error) {
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if u.Host == "" || bucket == "" {
+		return nil, fmt.Errorf("s3 blob store needs a host and a bucket")
+	}
+	s := &s3BlobStore{
+		endpoint:  "https://" + u.Host,
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    u.Query().Get("region"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if u.Scheme == "s3+http" {
+		s.endpoint = "http://" + u.Host
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if u.User != nil {
+		s.accessKey = u.User.Username()
+		s.secretKey, _ = u.User.Password()
+	}
+	return s, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	case resp.StatusCode/100 != 2:
+		return nil, s3Error(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3: %s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+// s3Escape encodes a path segment the way SigV4 expects: everything but
+// unreserved characters is percent-encoded.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3BlobStore) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, v := range strings.Split(path.Join(s.bucket, s.prefix, key), "/") {
+		segments = append(segments, s3Escape(v))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/"+strings.Join(segments, "/"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery is the query string as SigV4 signs it, sorted and escaped.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func (s *s3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if s.accessKey == "" {
+		return
+	}
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + req.Header.Get("x-amz-content-sha256"),
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
@@ -0,0 +1,151 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+// ClaimCheck moves job payloads out of broker messages. Payloads of messages
+// sent with SendAndAck are written to Store, and the data field is replaced by
+// a data_ref holding the digest. Wrap puts them back before the handler sees
+// the message.
+type ClaimCheck struct {
+	// Store keeps the payloads. If nil, payloads are sent inline and messages
+	// carrying a data_ref are rejected.
+	Store BlobStore
+	// Threshold is the smallest payload moved to Store, 256KiB if zero.
+	Threshold int
+	// Timeout bounds storing a payload, one minute if zero.
+	Timeout time.Duration
+}
+
+var blobRefName = (*tpb.BlobRef)(nil).ProtoReflect().Descriptor().FullName()
+
+// payloadFields returns the data and data_ref fields of m, if it has both.
+func payloadFields(m protoreflect.Message) (data, ref protoreflect.FieldDescriptor, ok bool) {
+	fields := m.Descriptor().Fields()
+	data, ref = fields.ByName("data"), fields.ByName("data_ref")
+	ok = data != nil && data.Kind() == protoreflect.BytesKind &&
+		ref != nil && ref.Message() != nil && ref.Message().FullName() == blobRefName
+	return data, ref, ok
+}
+
+func (c *ClaimCheck) offload(data proto.Message) (proto.Message, error) {
+	if c.Store == nil {
+		return data, nil
+	}
+	dataField, refField, ok := payloadFields(data.ProtoReflect())
+	if !ok {
+		return data, nil
+	}
+	payload := data.ProtoReflect().Get(dataField).Bytes()
+	threshold := c.Threshold
+	if threshold == 0 {
+		threshold = 256 << 10
+	}
+	if len(payload) < threshold {
+		return data, nil
+	}
+
+	sum := sha256.Sum256(payload)
+	ref := &tpb.BlobRef{
+		Sha256: hex.EncodeToString(sum[:]),
+		Size:   int64(len(payload)),
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := c.Store.Put(ctx, ref.Sha256, payload); err != nil {
+		return nil, fmt.Errorf("can't store payload: %w", err)
+	}
+
+	out := proto.Clone(data)
+	m := out.ProtoReflect()
+	m.Clear(dataField)
+	m.Set(refField, protoreflect.ValueOfMessage(ref.ProtoReflect()))
+	return out, nil
+}
+
+// Wrap returns a handler that fetches and verifies the payload of messages
+// carrying a data_ref and puts it back in the data field, so proc sees the
+// message as if the payload had been sent inline. Messages sent by proc are
+// offloaded in turn.
+func (c *ClaimCheck) Wrap(proc Handler) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		msg.claims = c
+		if err := c.resolve(ctx, msg); err != nil {
+			return err
+		}
+		return proc(ctx, msg)
+	}
+}
+
+func (c *ClaimCheck) resolve(ctx context.Context, msg *Message) error {
+	contentType, params, err := mime.ParseMediaType(msg.ContentType)
+	if err != nil || params["proto"] == "" {
+		return nil
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(params["proto"]))
+	if err != nil {
+		return nil
+	}
+	m := mt.New()
+	if err := unmarshalBody(msg.ContentType, msg.Body, m.Interface()); err != nil {
+		// Leave it to the handler to reject.
+		return nil
+	}
+	dataField, refField, ok := payloadFields(m)
+	if !ok || !m.Has(refField) {
+		return nil
+	}
+	ref, _ := m.Get(refField).Message().Interface().(*tpb.BlobRef)
+	if !ValidBlobKey(ref.GetSha256()) {
+		return Permanent(fmt.Errorf("message refers to payload with invalid digest %q", ref.GetSha256()))
+	}
+	if c.Store == nil {
+		return Permanent(fmt.Errorf("message refers to payload %s, but no blob store is configured", ref.GetSha256()))
+	}
+
+	err = Traced(ctx, "fetch payload", func(ctx context.Context) (err error) {
+		payload, err := c.Store.Get(ctx, ref.GetSha256())
+		if errors.Is(err, ErrBlobNotFound) {
+			return Permanent(err)
+		}
+		if err != nil {
+			return fmt.Errorf("can't fetch payload: %w", err)
+		}
+		sum := sha256.Sum256(payload)
+		want, _ := hex.DecodeString(ref.GetSha256())
+		if int64(len(payload)) != ref.GetSize() || !bytes.Equal(sum[:], want) {
+			return Permanent(fmt.Errorf("payload %s fails verification", ref.GetSha256()))
+		}
+		m.Clear(refField)
+		m.Set(dataField, protoreflect.ValueOfBytes(payload))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	body, _, err := marshalBody(m.Interface(), contentType == ContentTypeJSON)
+	if err != nil {
+		return Permanent(err)
+	}
+	msg.Body = body
+	return nil
+}
@@ -0,0 +1,68 @@
+package tools
+
+import (
+	"fmt"
+	"mime"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Content types of job messages. Either may name the message type in a proto
+// parameter, as in "application/json; proto=tickets.PrintJob". Bytes fields
+// such as data are base64 strings in JSON.
+const (
+	ContentTypeProtobuf = "application/vnd.google.protobuf"
+	ContentTypeJSON     = "application/json"
+)
+
+// Unmarshal decodes the body of msg into m according to the content type of
+// msg. Messages without a content type are taken to be binary protobuf. All
+// errors are permanent, including bodies the transport couldn't decompress.
+func Unmarshal(msg *Message, m proto.Message) error {
+	if encoding := msg.Header[HeaderContentEncoding]; encoding != "" && encoding != "identity" {
+		return Permanent(fmt.Errorf("can't decode %s body", encoding))
+	}
+	if err := unmarshalBody(msg.ContentType, msg.Body, m); err != nil {
+		return Permanent(err)
+	}
+	return nil
+}
+
+func unmarshalBody(contentType string, body []byte, m proto.Message) error {
+	if contentType == "" {
+		return proto.Unmarshal(body, m)
+	}
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("bad content type %q: %w", contentType, err)
+	}
+	if name := params["proto"]; name != "" && name != string(m.ProtoReflect().Descriptor().FullName()) {
+		return fmt.Errorf("expected %s, got %s", m.ProtoReflect().Descriptor().FullName(), name)
+	}
+	switch mt {
+	case ContentTypeProtobuf, "application/x-protobuf", "application/protobuf", "application/octet-stream":
+		return proto.Unmarshal(body, m)
+	case ContentTypeJSON:
+		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, m)
+	}
+	return fmt.Errorf("unsupported content type %q", contentType)
+}
+
+// marshalBody encodes m as binary protobuf or, if asJSON is set, as JSON, and
+// returns the body along with its content type.
+func marshalBody(m proto.Message, asJSON bool) ([]byte, string, error) {
+	mt, marshal := ContentTypeProtobuf, proto.Marshal
+	if asJSON {
+		mt, marshal = ContentTypeJSON, protojson.Marshal
+	}
+	body, err := marshal(m)
+	if err != nil {
+		return nil, "", err
+	}
+	// Naming the message type lets consumers such as ClaimCheck decode the
+	// body without knowing the queue.
+	return body, mime.FormatMediaType(mt, map[string]string{
+		"proto": string(m.ProtoReflect().Descriptor().FullName()),
+	}), nil
+}
@@ -0,0 +1,126 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+var testTexJob = &tpb.TexJob{JobId: "j1", Printer: "p1", Data: []byte("hi")}
+
+func TestUnmarshal(t *testing.T) {
+	binary, err := proto.Marshal(testTexJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonBody := []byte(`{"jobId":"j1","printer":"p1","data":"aGk=","unknownField":1}`)
+
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		header      map[string]string
+		body        []byte
+		wantErr     bool
+	}{
+		{name: "json", contentType: "application/json", body: jsonBody},
+		{name: "json with proto", contentType: "application/json; proto=tickets.TexJob", body: jsonBody},
+		{name: "protobuf", contentType: ContentTypeProtobuf, body: binary},
+		{name: "protobuf with proto", contentType: "application/vnd.google.protobuf; proto=tickets.TexJob", body: binary},
+		{name: "x-protobuf", contentType: "application/x-protobuf", body: binary},
+		{name: "octet-stream", contentType: "application/octet-stream", body: binary},
+		{name: "legacy", body: binary},
+		{name: "identity encoding", contentType: ContentTypeProtobuf, header: map[string]string{HeaderContentEncoding: "identity"}, body: binary},
+		{name: "proto mismatch", contentType: "application/json; proto=tickets.PrintJob", body: jsonBody, wantErr: true},
+		{name: "protobuf proto mismatch", contentType: "application/x-protobuf; proto=tickets.BinaryJob", body: binary, wantErr: true},
+		{name: "unknown content type", contentType: "text/plain", body: jsonBody, wantErr: true},
+		{name: "bad content type", contentType: "application/json; proto", body: jsonBody, wantErr: true},
+		{name: "bad json", contentType: ContentTypeJSON, body: []byte(`{"jobId":`), wantErr: true},
+		{name: "json as protobuf", contentType: ContentTypeProtobuf, body: jsonBody, wantErr: true},
+		{name: "undecoded body", contentType: ContentTypeProtobuf, header: map[string]string{HeaderContentEncoding: "gzip"}, body: binary, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var job tpb.TexJob
+			err := Unmarshal(&Message{ContentType: tt.contentType, Header: tt.header, Body: tt.body}, &job)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Unmarshal succeeded: %v", &job)
+				}
+				if !IsPermanent(err) {
+					t.Errorf("Unmarshal error %v is not permanent", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(&job, testTexJob) {
+				t.Errorf("Unmarshal = %v, want %v", &job, testTexJob)
+			}
+		})
+	}
+}
+
+func TestMarshalBody(t *testing.T) {
+	for _, tt := range []struct {
+		asJSON          bool
+		wantContentType string
+	}{
+		{false, "application/vnd.google.protobuf; proto=tickets.TexJob"},
+		{true, "application/json; proto=tickets.TexJob"},
+	} {
+		body, contentType, err := marshalBody(testTexJob, tt.asJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != tt.wantContentType {
+			t.Errorf("marshalBody(json %v) content type = %q, want %q", tt.asJSON, contentType, tt.wantContentType)
+		}
+		if json.Valid(body) != tt.asJSON {
+			t.Errorf("marshalBody(json %v) = %q", tt.asJSON, body)
+		}
+		var job tpb.TexJob
+		if err := Unmarshal(&Message{ContentType: contentType, Body: body}, &job); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(&job, testTexJob) {
+			t.Errorf("marshalBody(json %v) decoded to %v, want %v", tt.asJSON, &job, testTexJob)
+		}
+	}
+}
+
+func TestSendAndAckJSON(t *testing.T) {
+	tr := newTestMemTransport()
+	tr.Subscribe("jobs", 1, func(ctx context.Context, msg *Message) error {
+		var job tpb.TexJob
+		if err := Unmarshal(msg, &job); err != nil {
+			return err
+		}
+		return SendAndAck(msg, "out", &job, AsJSON(true))
+	})
+	out := collect(tr, "out")
+	publishJob(t, tr, "jobs", testTexJob)
+	runMem(t, tr)
+
+	msg := receive(t, out)
+	if want := "application/json; proto=tickets.TexJob"; msg.ContentType != want {
+		t.Errorf("content type = %q, want %q", msg.ContentType, want)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(msg.Body, &fields); err != nil {
+		t.Fatalf("body %q is not JSON: %v", msg.Body, err)
+	}
+	if fields["jobId"] != "j1" || fields["data"] != "aGk=" {
+		t.Errorf("body = %s", msg.Body)
+	}
+	var job tpb.TexJob
+	if err := Unmarshal(msg, &job); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&job, testTexJob) {
+		t.Errorf("received %v, want %v", &job, testTexJob)
+	}
+}
@@ -0,0 +1,168 @@
+package tools
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HeaderContentEncoding names the compression applied to a message body.
+// Messages without it are sent as they are.
+const HeaderContentEncoding = "content-encoding"
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// DefaultMaxDecodedSize is the largest body decompressed if
+// Compression.MaxDecodedSize is zero.
+const DefaultMaxDecodedSize = 64 << 20
+
+// CompressionRule is how bodies sent to one destination are compressed.
+type CompressionRule struct {
+	// Encoding is gzip, zstd or empty for none.
+	Encoding string
+	// Threshold is the smallest body worth compressing.
+	Threshold int
+}
+
+// Compression selects the CompressionRule for each destination. Transports
+// apply it when sending and decompress whatever they receive.
+type Compression struct {
+	Default CompressionRule
+	Queues  map[string]CompressionRule
+	// MaxDecodedSize bounds received bodies after decompression, so a small
+	// message can't expand to exhaust memory. Larger ones are left encoded
+	// and get dead-lettered.
+	MaxDecodedSize int
+}
+
+// ParseCompression parses rules of the form [queue=]encoding[:threshold], for
+// instance "zstd:4096" or "/queue/binary=gzip". A rule without a queue is the
+// default for all other destinations.
+func ParseCompression(rules []string) (Compression, error) {
+	var result Compression
+	for _, v := range rules {
+		queue, spec, ok := strings.Cut(v, "=")
+		if !ok {
+			queue, spec = "", v
+		}
+		encoding, threshold, _ := strings.Cut(spec, ":")
+		rule := CompressionRule{Encoding: encoding}
+		switch encoding {
+		case "", "none":
+			rule.Encoding = ""
+		case "gzip", "zstd":
+		default:
+			return result, fmt.Errorf("unknown compression %q", encoding)
+		}
+		if threshold != "" {
+			n, err := strconv.Atoi(threshold)
+			if err != nil || n < 0 {
+				return result, fmt.Errorf("invalid compression threshold %q", threshold)
+			}
+			rule.Threshold = n
+		}
+		if queue == "" {
+			result.Default = rule
+			continue
+		}
+		if result.Queues == nil {
+			result.Queues = make(map[string]CompressionRule)
+		}
+		result.Queues[queue] = rule
+	}
+	return result, nil
+}
+
+func (c Compression) rule(dest string) CompressionRule {
+	if r, ok := c.Queues[dest]; ok {
+		return r
+	}
+	return c.Default
+}
+
+// encode returns msg with its body compressed as configured for dest. The
+// caller's message is left alone.
+func (c Compression) encode(dest string, msg *Message) (*Message, error) {
+	r := c.rule(dest)
+	if r.Encoding == "" || len(msg.Body) < r.Threshold || msg.Header[HeaderContentEncoding] != "" {
+		return msg, nil
+	}
+
+	var body []byte
+	switch r.Encoding {
+	case "zstd":
+		body = zstdEncoder.EncodeAll(msg.Body, nil)
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(msg.Body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	if len(body) >= len(msg.Body) {
+		return msg, nil
+	}
+
+	out := *msg
+	out.Body = body
+	out.Header = make(map[string]string, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		out.Header[k] = v
+	}
+	out.Header[HeaderContentEncoding] = r.Encoding
+	return &out, nil
+}
+
+// decode decompresses a received body in place. A body that can't be
+// decoded or exceeds MaxDecodedSize is left as it is, with the header, for
+// Unmarshal to reject.
+func (c Compression) decode(msg *Message) {
+	encoding := msg.Header[HeaderContentEncoding]
+	if encoding == "" || encoding == "identity" {
+		return
+	}
+	limit := c.MaxDecodedSize
+	if limit <= 0 {
+		limit = DefaultMaxDecodedSize
+	}
+
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "zstd":
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(bytes.NewReader(msg.Body), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit))); err == nil {
+			defer zr.Close()
+			r = zr
+		}
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(msg.Body))
+	default:
+		err = fmt.Errorf("unknown encoding")
+	}
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	}
+	if err == nil && len(body) > limit {
+		err = fmt.Errorf("decoded body exceeds %d bytes", limit)
+	}
+	if err != nil {
+		log.Warnf("can't decode %s body of message from %s: %v", encoding, msg.Destination, err)
+		return
+	}
+
+	msg.Body = body
+	delete(msg.Header, HeaderContentEncoding)
+}
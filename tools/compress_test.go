@@ -0,0 +1,133 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+func TestParseCompression(t *testing.T) {
+	c, err := ParseCompression([]string{"zstd:4096", "/queue/binary=gzip", "/queue/report=none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dest, want := range map[string]CompressionRule{
+		"/queue/tex":    {Encoding: "zstd", Threshold: 4096},
+		"/queue/binary": {Encoding: "gzip"},
+		"/queue/report": {},
+	} {
+		if got := c.rule(dest); got != want {
+			t.Errorf("rule(%q) = %+v, want %+v", dest, got, want)
+		}
+	}
+	for _, v := range []string{"brotli", "gzip:-1", "zstd:many"} {
+		if _, err := ParseCompression([]string{v}); err == nil {
+			t.Errorf("ParseCompression(%q) succeeded", v)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("%!PS-Adobe-3.0\n"), 1000)
+	for _, encoding := range []string{"gzip", "zstd"} {
+		c := Compression{Default: CompressionRule{Encoding: encoding, Threshold: 100}}
+		in := &Message{Body: body, Header: map[string]string{"x-other": "1"}}
+		out, err := c.encode("q", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Header[HeaderContentEncoding] != encoding || len(out.Body) >= len(body) {
+			t.Errorf("%s: encoded to %d bytes with headers %v", encoding, len(out.Body), out.Header)
+		}
+		if in.Header[HeaderContentEncoding] != "" || !bytes.Equal(in.Body, body) {
+			t.Errorf("%s: encode changed the caller's message", encoding)
+		}
+
+		c.decode(out)
+		if _, ok := out.Header[HeaderContentEncoding]; ok || !bytes.Equal(out.Body, body) || out.Header["x-other"] != "1" {
+			t.Errorf("%s: decoded %d bytes with headers %v", encoding, len(out.Body), out.Header)
+		}
+
+		small := &Message{Body: []byte("short")}
+		if out, _ := c.encode("q", small); out != small {
+			t.Errorf("%s: body below the threshold was encoded", encoding)
+		}
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	// Megabytes of zeros compress to almost nothing.
+	bomb := make([]byte, 4<<20)
+	for _, encoding := range []string{"gzip", "zstd"} {
+		out, err := Compression{Default: CompressionRule{Encoding: encoding}}.encode("q", &Message{Body: bomb})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := out.Body
+
+		for _, tt := range []struct {
+			limit   int
+			decoded bool
+		}{
+			{len(bomb), true},
+			{len(bomb) - 1, false},
+			{64 << 10, false},
+		} {
+			msg := &Message{Body: encoded, Header: map[string]string{HeaderContentEncoding: encoding}}
+			Compression{MaxDecodedSize: tt.limit}.decode(msg)
+			if decoded := msg.Header[HeaderContentEncoding] == ""; decoded != tt.decoded || decoded && len(msg.Body) != len(bomb) || !decoded && !bytes.Equal(msg.Body, encoded) {
+				t.Errorf("%s with limit %d: decoded %v to %d bytes, want decoded %v", encoding, tt.limit, decoded, len(msg.Body), tt.decoded)
+			}
+		}
+	}
+}
+
+func TestDecodeFailure(t *testing.T) {
+	for _, encoding := range []string{"gzip", "zstd", "brotli"} {
+		msg := &Message{Body: []byte("not compressed"), Header: map[string]string{HeaderContentEncoding: encoding}}
+		Compression{}.decode(msg)
+		if msg.Header[HeaderContentEncoding] != encoding || string(msg.Body) != "not compressed" {
+			t.Errorf("%s: undecodable message changed to %q, %v", encoding, msg.Body, msg.Header)
+		}
+		if err := Unmarshal(msg, &tpb.TexJob{}); !IsPermanent(err) {
+			t.Errorf("%s: Unmarshal of an undecodable body returned %v, want a permanent error", encoding, err)
+		}
+	}
+}
+
+// TestDecodeLimitDeadLetter checks that over-limit messages are dead-lettered
+// as they came.
+func TestDecodeLimitDeadLetter(t *testing.T) {
+	body, contentType, err := marshalBody(&tpb.TexJob{JobId: "1", Data: make([]byte, 1<<20)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := Compression{Default: CompressionRule{Encoding: "zstd"}}
+	out, err := sender.encode("jobs", &Message{ContentType: contentType, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newTestMemTransport()
+	tr.Compression.MaxDecodedSize = 64 << 10
+	retry := RetryPolicy{DeadLetterQueue: "dlq"}
+	tr.Subscribe("jobs", 1, retry.Wrap(func(ctx context.Context, msg *Message) error {
+		var job tpb.TexJob
+		if err := Unmarshal(msg, &job); err != nil {
+			return err
+		}
+		t.Errorf("over-limit job %q was decoded", job.GetJobId())
+		return MaybeAck(msg)
+	}))
+	// The dead letter is over the limit as well, so it stays encoded.
+	dlq := collect(tr, "dlq")
+	tr.Publish("jobs", out)
+	runMem(t, tr)
+
+	msg := receive(t, dlq)
+	if msg.Header[HeaderContentEncoding] != "zstd" || !bytes.Equal(msg.Body, out.Body) {
+		t.Errorf("dead letter has %d bytes, encoding %q, want the message as sent", len(msg.Body), msg.Header[HeaderContentEncoding])
+	}
+}
@@ -2,22 +2,128 @@ package tools
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/url"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type StompConfig struct {
-	Network, Address, Vhost, Username, Password string
-	Params                                      map[string]string
+	Network, Vhost, Username, Password string
+	Params                             map[string]string
+
+	// Addresses lists the brokers to try, in order unless Randomize is set.
+	Addresses []string
+	Randomize bool
+
+	// TLSConfig is set when the DSN network is tcp+tls.
+	TLSConfig *tls.Config
+
+	HeartBeatSend, HeartBeatRecv time.Duration
+	ReceiptTimeout, WriteTimeout time.Duration
+	ConnectTimeout               time.Duration
+	Prefetch                     int
+	ClientID                     string
+	Headers                      map[string]string
+}
+
+var tlsParams = map[string]bool{"ca": true, "cert": true, "key": true, "servername": true}
+
+// applyParams maps DSN query parameters onto connection options:
+//
+//	heartbeat=10s,10s        send and receive heart-beat intervals
+//	receipt-timeout=30s      time to wait for a receipt
+//	write-timeout=30s        time to wait for a frame to be sent
+//	connect-timeout=10s      time to wait for each broker to accept a connection
+//	randomize=true           try failover brokers in random order
+//	prefetch=1               broker prefetch window per subscription
+//	client-id=busyprint      client-id sent with CONNECT
+//	header.<name>=<value>    any other CONNECT header
+//	ca, cert, key, servername  TLS options, see tlsConfigFromParams
+func (c *StompConfig) applyParams() error {
+	var err error
+	for k, v := range c.Params {
+		switch {
+		case k == "heartbeat":
+			send, recv, ok := strings.Cut(v, ",")
+			if !ok {
+				recv = send
+			}
+			if c.HeartBeatSend, err = time.ParseDuration(send); err != nil {
+				return fmt.Errorf("invalid dsn parameter %s=%q: %w", k, v, err)
+			}
+			if c.HeartBeatRecv, err = time.ParseDuration(recv); err != nil {
+				return fmt.Errorf("invalid dsn parameter %s=%q: %w", k, v, err)
+			}
+		case k == "receipt-timeout":
+			if c.ReceiptTimeout, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("invalid dsn parameter %s=%q: %w", k, v, err)
+			}
+		case k == "write-timeout":
+			if c.WriteTimeout, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("invalid dsn parameter %s=%q: %w", k, v, err)
+			}
+		case k == "connect-timeout":
+			if c.ConnectTimeout, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("invalid dsn parameter %s=%q: %w", k, v, err)
+			}
+		case k == "randomize":
+			if c.Randomize, err = strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("invalid dsn parameter %s=%q: %w", k, v, err)
+			}
+		case k == "prefetch":
+			if c.Prefetch, err = strconv.Atoi(v); err != nil || c.Prefetch < 0 {
+				return fmt.Errorf("invalid dsn parameter %s=%q", k, v)
+			}
+		case k == "client-id":
+			c.ClientID = v
+		case strings.HasPrefix(k, "header.") && len(k) > len("header."):
+			if c.Headers == nil {
+				c.Headers = make(map[string]string)
+			}
+			c.Headers[strings.TrimPrefix(k, "header.")] = v
+		case tlsParams[k]:
+			if c.TLSConfig == nil {
+				return fmt.Errorf("dsn parameter %q requires a tls network such as tcp+tls", k)
+			}
+		default:
+			return fmt.Errorf("unknown dsn parameter %q", k)
+		}
+	}
+	return nil
+}
+
+// SubscribeOpts returns the SUBSCRIBE frame options implied by the config for
+// a subscription served by the given number of workers. Unless set explicitly,
+// the prefetch window matches the number of workers.
+func (c *StompConfig) SubscribeOpts(workers int) []func(*frame.Frame) error {
+	var opts []func(*frame.Frame) error
+	prefetch := c.Prefetch
+	if prefetch == 0 && workers > 1 {
+		prefetch = workers
+	}
+	if prefetch > 0 {
+		opts = append(opts, stomp.SubscribeOpt.Header("activemq.prefetchSize", strconv.Itoa(prefetch)))
+	}
+	return opts
 }
 
 var dsnPattern = regexp.MustCompile(
 	`^(?:(?P<user>.*?)(?::(?P<passwd>.*))?@)?` + // [user[:password]@]
-		`(?:(?P<net>[^\(]*)(?:\((?P<addr>[^\)]*)\))?)?` + // [net[(addr)]]
+		`(?:(?P<net>[^\(/]*)(?:\((?P<addr>[^\)]*)\))?)?` + // [[failover:]net[(addr[,addr...])]]
 		`\/(?P<vhost>.*?)` + // /dbname
 		`(?:\?(?P<params>[^\?]*))?$`) // [?param1=value1&paramN=valueN]
 
@@ -32,7 +138,11 @@ func ParseStompDSN(s string) (StompConfig, error) {
 	for i, v := range m {
 		switch cgn[i] {
 		case "addr":
-			result.Address = v
+			for _, a := range strings.Split(v, ",") {
+				if a = strings.TrimSpace(a); a != "" {
+					result.Addresses = append(result.Addresses, a)
+				}
+			}
 		case "net":
 			result.Network = v
 		case "user":
@@ -41,27 +151,130 @@ func ParseStompDSN(s string) (StompConfig, error) {
 			result.Password = v
 		case "vhost":
 			result.Vhost = v
+		case "params":
+			if v == "" {
+				continue
+			}
+			q, err := url.ParseQuery(v)
+			if err != nil {
+				return result, fmt.Errorf("can't parse dsn params %q: %w", v, err)
+			}
+			result.Params = make(map[string]string, len(q))
+			for k, vs := range q {
+				result.Params[k] = vs[len(vs)-1]
+			}
 		}
 	}
 
-	if result.Network == "" {
+	defaultPort := ":61613"
+	result.Network = strings.TrimPrefix(result.Network, "failover:")
+	switch result.Network {
+	case "":
 		result.Network = "tcp"
+	case "tcp+tls", "tcp4+tls", "tcp6+tls":
+		result.Network = strings.TrimSuffix(result.Network, "+tls")
+		defaultPort = ":61614"
+		tc, err := tlsConfigFromParams(result.Params)
+		if err != nil {
+			return result, err
+		}
+		result.TLSConfig = tc
+	}
+
+	if err := result.applyParams(); err != nil {
+		return result, err
+	}
+
+	if result.ConnectTimeout == 0 {
+		result.ConnectTimeout = 10 * time.Second
+	}
+
+	if len(result.Addresses) == 0 {
+		result.Addresses = []string{"localhost"}
+	}
+	for i, v := range result.Addresses {
+		if !strings.Contains(v, ":") {
+			result.Addresses[i] = v + defaultPort
+		}
+	}
+
+	return result, nil
+}
+
+// tlsConfigFromParams builds a client TLS config from the ca, cert, key and
+// servername DSN parameters. All of them are optional.
+func tlsConfigFromParams(params map[string]string) (*tls.Config, error) {
+	result := &tls.Config{
+		ServerName: params["servername"],
+	}
+
+	if ca := params["ca"]; ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("can't read ca bundle: %w", err)
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", ca)
+		}
 	}
 
-	if result.Address == "" {
-		result.Address = "localhost"
+	certFile, keyFile := params["cert"], params["key"]
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both cert and key must be set for client certificate")
 	}
-	if !strings.Contains(result.Address, ":") {
-		result.Address += ":61613"
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %w", err)
+		}
+		result.Certificates = []tls.Certificate{cert}
 	}
 
 	return result, nil
 }
 
-func DialStomp(ctx context.Context, cfg StompConfig) (*stomp.Conn, error) {
-	var d net.Dialer
+// DialStomp connects to the first reachable broker from cfg.Addresses and
+// returns the connection along with the address it is attached to.
+func DialStomp(ctx context.Context, cfg StompConfig) (*stomp.Conn, string, error) {
+	addrs := cfg.Addresses
+	if cfg.Randomize {
+		addrs = append([]string(nil), addrs...)
+		rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	}
 
-	conn, err := d.DialContext(ctx, cfg.Network, cfg.Address)
+	var errs []error
+	for _, addr := range addrs {
+		sc, err := dialStompAddr(ctx, cfg, addr)
+		if err == nil {
+			log.Infof("connected to stomp broker %s", addr)
+			return sc, addr, nil
+		}
+		log.Warnf("can't connect to stomp broker %s: %v", addr, err)
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+func dialStompAddr(ctx context.Context, cfg StompConfig, addr string) (*stomp.Conn, error) {
+	if cfg.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ConnectTimeout)
+		defer cancel()
+	}
+
+	var conn net.Conn
+	var err error
+	if cfg.TLSConfig != nil {
+		d := tls.Dialer{Config: cfg.TLSConfig}
+		conn, err = d.DialContext(ctx, cfg.Network, addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, cfg.Network, addr)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +286,21 @@ func DialStomp(ctx context.Context, cfg StompConfig) (*stomp.Conn, error) {
 	if cfg.Vhost != "" {
 		opts = append(opts, stomp.ConnOpt.Host(cfg.Vhost))
 	}
+	if cfg.HeartBeatSend != 0 || cfg.HeartBeatRecv != 0 {
+		opts = append(opts, stomp.ConnOpt.HeartBeat(cfg.HeartBeatSend, cfg.HeartBeatRecv))
+	}
+	if cfg.ReceiptTimeout != 0 {
+		opts = append(opts, stomp.ConnOpt.RcvReceiptTimeout(cfg.ReceiptTimeout))
+	}
+	if cfg.WriteTimeout != 0 {
+		opts = append(opts, stomp.ConnOpt.MsgSendTimeout(cfg.WriteTimeout))
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, stomp.ConnOpt.Header("client-id", cfg.ClientID))
+	}
+	for k, v := range cfg.Headers {
+		opts = append(opts, stomp.ConnOpt.Header(k, v))
+	}
 
 	sc, err := stomp.Connect(conn, opts...)
 	if err != nil {
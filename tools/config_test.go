@@ -0,0 +1,331 @@
+package tools
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert issues a certificate signed by parent, or a self-signed CA if
+// parent is nil, and writes it and its key as PEM files to dir.
+func newTestCert(t *testing.T, dir, name string, parent *testCert, usage x509.ExtKeyUsage, dnsNames ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	if err := os.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// serveTLSStomp runs a fake broker behind TLS. It reports the common name of
+// each client certificate, or "" if the client sent none, once the handshake
+// is done.
+func serveTLSStomp(t *testing.T, config *tls.Config) (string, <-chan string) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := make(chan string, 10)
+	b := newFakeBroker(t, ln, func(conn net.Conn) bool {
+		tc := conn.(*tls.Conn)
+		if err := tc.Handshake(); err != nil {
+			return false
+		}
+		var cn string
+		if peers := tc.ConnectionState().PeerCertificates; len(peers) > 0 {
+			cn = peers[0].Subject.CommonName
+		}
+		clients <- cn
+		return true
+	})
+	return b.addr, clients
+}
+
+func TestDialStompTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, 0)
+	server := newTestCert(t, dir, "server", ca, x509.ExtKeyUsageServerAuth, "printing.test")
+	client := newTestCert(t, dir, "client", ca, x509.ExtKeyUsageClientAuth)
+
+	serverCert, err := tls.LoadX509KeyPair(server.certFile, server.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	params := func(kv ...string) string {
+		v := url.Values{}
+		for i := 0; i < len(kv); i += 2 {
+			v.Set(kv[i], kv[i+1])
+		}
+		return v.Encode()
+	}
+
+	tests := []struct {
+		name       string
+		clientAuth tls.ClientAuthType
+		params     string
+		wantCN     string
+		wantErr    string
+	}{
+		{
+			name:   "ca and servername",
+			params: params("ca", ca.certFile, "servername", "printing.test"),
+		},
+		{
+			name:       "client certificate",
+			clientAuth: tls.RequireAndVerifyClientCert,
+			params:     params("ca", ca.certFile, "servername", "printing.test", "cert", client.certFile, "key", client.keyFile),
+			wantCN:     "client",
+		},
+		{
+			name:       "missing client certificate",
+			clientAuth: tls.RequireAndVerifyClientCert,
+			params:     params("ca", ca.certFile, "servername", "printing.test"),
+			wantErr:    "certificate",
+		},
+		{
+			name:    "unknown ca",
+			params:  params("servername", "printing.test"),
+			wantErr: "unknown authority",
+		},
+		{
+			name:    "wrong servername",
+			params:  params("ca", ca.certFile, "servername", "other.test"),
+			wantErr: "other.test",
+		},
+		{
+			name:    "no servername",
+			params:  params("ca", ca.certFile),
+			wantErr: "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, clients := serveTLSStomp(t, &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   tt.clientAuth,
+				ClientCAs:    clientCAs,
+			})
+			cfg, err := ParseStompDSN("tcp+tls(" + addr + ")/?" + tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			sc, err := dialStompAddr(ctx, cfg, addr)
+			if tt.wantErr != "" {
+				if err == nil {
+					sc.MustDisconnect()
+					t.Fatalf("dialStompAddr() succeeded, want error containing %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dialStompAddr() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialStompAddr() error = %v", err)
+			}
+			defer sc.MustDisconnect()
+			if cn := <-clients; cn != tt.wantCN {
+				t.Errorf("client certificate CN = %q, want %q", cn, tt.wantCN)
+			}
+		})
+	}
+}
+
+func TestTLSParamErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, 0)
+	client := newTestCert(t, dir, "client", ca, x509.ExtKeyUsageClientAuth)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dsn     string
+		wantErr string
+	}{
+		{"tcp+tls(broker)/?cert=" + client.certFile, "both cert and key"},
+		{"tcp+tls(broker)/?key=" + client.keyFile, "both cert and key"},
+		{"tcp+tls(broker)/?cert=" + client.certFile + "&key=" + ca.keyFile, "client certificate"},
+		{"tcp+tls(broker)/?ca=" + garbage, "no certificates"},
+		{"tcp+tls(broker)/?ca=" + filepath.Join(dir, "missing.pem"), "ca bundle"},
+		{"tcp(broker)/?ca=" + ca.certFile, "requires a tls network"},
+		{"tcp(broker)/?servername=printing.test", "requires a tls network"},
+		{"/?cert=" + client.certFile + "&key=" + client.keyFile, "requires a tls network"},
+	}
+	for _, tt := range tests {
+		_, err := ParseStompDSN(tt.dsn)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseStompDSN(%q) error = %v, want it to contain %q", tt.dsn, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseStompDSN(t *testing.T) {
+	tests := []struct {
+		dsn                          string
+		network, vhost, user, passwd string
+		addresses                    []string
+		tls                          bool
+	}{
+		{dsn: "/", network: "tcp", addresses: []string{"localhost:61613"}},
+		{dsn: "tcp(broker)/", network: "tcp", addresses: []string{"broker:61613"}},
+		{dsn: "tcp(broker:1234)/vhost", network: "tcp", vhost: "vhost", addresses: []string{"broker:1234"}},
+		{dsn: "user:secret@tcp(broker)/", network: "tcp", user: "user", passwd: "secret", addresses: []string{"broker:61613"}},
+		{dsn: "user@tcp(broker)/", network: "tcp", user: "user", addresses: []string{"broker:61613"}},
+		{dsn: "tcp6([::1]:61613)/", network: "tcp6", addresses: []string{"[::1]:61613"}},
+		{dsn: "tcp+tls(broker)/", network: "tcp", addresses: []string{"broker:61614"}, tls: true},
+		{dsn: "tcp4+tls(broker:1)/", network: "tcp4", addresses: []string{"broker:1"}, tls: true},
+		{dsn: "failover:(a,b:1234, c)/", network: "tcp", addresses: []string{"a:61613", "b:1234", "c:61613"}},
+		{dsn: "failover:tcp(a,b)/", network: "tcp", addresses: []string{"a:61613", "b:61613"}},
+		{dsn: "failover:tcp+tls(a,b)/", network: "tcp", addresses: []string{"a:61614", "b:61614"}, tls: true},
+	}
+	for _, tt := range tests {
+		cfg, err := ParseStompDSN(tt.dsn)
+		if err != nil {
+			t.Errorf("ParseStompDSN(%q) error = %v", tt.dsn, err)
+			continue
+		}
+		if cfg.Network != tt.network || cfg.Vhost != tt.vhost || cfg.Username != tt.user || cfg.Password != tt.passwd {
+			t.Errorf("ParseStompDSN(%q) = network %q vhost %q user %q password %q, want %q %q %q %q",
+				tt.dsn, cfg.Network, cfg.Vhost, cfg.Username, cfg.Password, tt.network, tt.vhost, tt.user, tt.passwd)
+		}
+		if strings.Join(cfg.Addresses, " ") != strings.Join(tt.addresses, " ") {
+			t.Errorf("ParseStompDSN(%q) addresses = %q, want %q", tt.dsn, cfg.Addresses, tt.addresses)
+		}
+		if (cfg.TLSConfig != nil) != tt.tls {
+			t.Errorf("ParseStompDSN(%q) TLS = %v, want %v", tt.dsn, cfg.TLSConfig != nil, tt.tls)
+		}
+		if cfg.ConnectTimeout != 10*time.Second {
+			t.Errorf("ParseStompDSN(%q) connect timeout = %v, want the 10s default", tt.dsn, cfg.ConnectTimeout)
+		}
+	}
+}
+
+func TestParseStompDSNParams(t *testing.T) {
+	tests := []struct {
+		params string
+		check  func(StompConfig) bool
+	}{
+		{"heartbeat=10s", func(c StompConfig) bool {
+			return c.HeartBeatSend == 10*time.Second && c.HeartBeatRecv == 10*time.Second
+		}},
+		{"heartbeat=5s,15s", func(c StompConfig) bool { return c.HeartBeatSend == 5*time.Second && c.HeartBeatRecv == 15*time.Second }},
+		{"receipt-timeout=30s", func(c StompConfig) bool { return c.ReceiptTimeout == 30*time.Second }},
+		{"write-timeout=20s", func(c StompConfig) bool { return c.WriteTimeout == 20*time.Second }},
+		{"connect-timeout=3s", func(c StompConfig) bool { return c.ConnectTimeout == 3*time.Second }},
+		{"randomize=true", func(c StompConfig) bool { return c.Randomize }},
+		{"prefetch=7", func(c StompConfig) bool { return c.Prefetch == 7 }},
+		{"client-id=busyprint", func(c StompConfig) bool { return c.ClientID == "busyprint" }},
+		{"header.x-a=1&header.x-b=2", func(c StompConfig) bool {
+			return len(c.Headers) == 2 && c.Headers["x-a"] == "1" && c.Headers["x-b"] == "2"
+		}},
+		{"prefetch=1&prefetch=3", func(c StompConfig) bool { return c.Prefetch == 3 }},
+	}
+	for _, tt := range tests {
+		dsn := "tcp(broker)/?" + tt.params
+		cfg, err := ParseStompDSN(dsn)
+		if err != nil {
+			t.Errorf("ParseStompDSN(%q) error = %v", dsn, err)
+			continue
+		}
+		if !tt.check(cfg) {
+			t.Errorf("ParseStompDSN(%q) = %+v, parameter not applied", dsn, cfg)
+		}
+	}
+}
+
+func TestParseStompDSNErrors(t *testing.T) {
+	tests := []struct {
+		dsn     string
+		wantErr string
+	}{
+		{"broker", "can't parse dsn"},
+		{"tcp(broker)/?read-timeout=30s", `unknown dsn parameter "read-timeout"`},
+		{"tcp(broker)/?bogus=1", `unknown dsn parameter "bogus"`},
+		{"tcp(broker)/?header.=1", `unknown dsn parameter "header."`},
+		{"tcp(broker)/?heartbeat=often", "invalid dsn parameter heartbeat"},
+		{"tcp(broker)/?heartbeat=1s,often", "invalid dsn parameter heartbeat"},
+		{"tcp(broker)/?receipt-timeout=x", "invalid dsn parameter receipt-timeout"},
+		{"tcp(broker)/?write-timeout=x", "invalid dsn parameter write-timeout"},
+		{"tcp(broker)/?connect-timeout=x", "invalid dsn parameter connect-timeout"},
+		{"tcp(broker)/?randomize=maybe", "invalid dsn parameter randomize"},
+		{"tcp(broker)/?prefetch=-1", "invalid dsn parameter prefetch"},
+		{"tcp(broker)/?prefetch=x", "invalid dsn parameter prefetch"},
+		{"tcp(broker)/?a=%zz", "can't parse dsn params"},
+	}
+	for _, tt := range tests {
+		_, err := ParseStompDSN(tt.dsn)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseStompDSN(%q) error = %v, want it to contain %q", tt.dsn, err, tt.wantErr)
+		}
+	}
+}
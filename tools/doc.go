@@ -0,0 +1,32 @@
+// Package tools holds what the printing stages share: the STOMP and in-memory
+// transports, message encoding, retries, claim checks and signing.
+//
+// # Signatures
+//
+// A stage with a signing key signs every message it sends, and a stage with
+// accepted keys dead-letters messages not signed with one of them. Producers
+// outside this repository, such as the web system, sign jobs the same way.
+//
+// The signature covers the bytes
+//
+//	"printing3-v1" LF content-type LF body
+//
+// where content-type is the content-type header exactly as sent, such as
+// "application/json; proto=tickets.PrintJob", and body is the encoded message
+// before any content-encoding is applied. If the payload was moved to a blob
+// store, the body is the message carrying the data_ref. The signature goes in
+// the x-signature header in standard base64 with padding, and the id of the
+// key in the x-signature-key-id header. With hmac-sha256 the signature is the
+// 32-byte HMAC-SHA256 of the bytes above; with ed25519 it is the 64-byte
+// Ed25519 signature of them.
+//
+// Keys are configured as id:algorithm:base64, see ParseSigningKey. The id only
+// names the key, so several keys can be accepted at once while rotating them.
+// For example, an HMAC secret, an Ed25519 seed and its public key can be made
+// with
+//
+//	openssl rand -base64 32
+//	openssl genpkey -algorithm ed25519 -outform DER -out key.der
+//	tail -c 32 key.der | base64
+//	openssl pkey -inform DER -in key.der -pubout -outform DER | tail -c 32 | base64
+package tools
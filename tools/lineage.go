@@ -0,0 +1,121 @@
+package tools
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Lineage headers carried from the first message of a job through every stage.
+const (
+	HeaderCorrelationID   = "x-correlation-id"
+	HeaderOriginMessageID = "x-origin-message-id"
+	HeaderOriginTimestamp = "x-origin-timestamp"
+	HeaderStage           = "x-stage"
+	HeaderStageTimestamp  = "x-stage-timestamp"
+)
+
+type ctxKey int
+
+const logEntryKey ctxKey = iota
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// CorrelationID identifies the job across stages. Jobs entering the pipeline
+// without one are identified by the id of their first message.
+func (m *Message) CorrelationID() string {
+	return firstNonEmpty(m.Header[HeaderCorrelationID], m.Header["correlation-id"], m.Header["message-id"])
+}
+
+func (m *Message) originMessageID() string {
+	return firstNonEmpty(m.Header[HeaderOriginMessageID], m.Header["message-id"])
+}
+
+func (m *Message) originTimestamp() string {
+	return firstNonEmpty(m.Header[HeaderOriginTimestamp], m.Header["timestamp"])
+}
+
+// lineageHeaders returns the headers a message produced while handling in
+// should carry.
+func lineageHeaders(in *Message) map[string]string {
+	result := map[string]string{
+		HeaderStageTimestamp: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}
+	for k, v := range map[string]string{
+		HeaderCorrelationID:   in.CorrelationID(),
+		HeaderOriginMessageID: in.originMessageID(),
+		HeaderOriginTimestamp: in.originTimestamp(),
+		HeaderStage:           in.stage,
+	} {
+		if v != "" {
+			result[k] = v
+		}
+	}
+	for k, v := range in.forward {
+		result[k] = v
+	}
+	return result
+}
+
+// WithStage names the pipeline stage proc implements. Messages sent while
+// handling carry the name, and proc gets a context with a span for the stage
+// and a Log entry having the message lineage as fields. Outcomes are counted
+// in the stage metrics.
+func WithStage(stage string, proc Handler) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		msg.stage = stage
+		ctx, span := startStageSpan(ctx, stage, msg)
+		defer span.End()
+
+		jobsReceived.WithLabelValues(stage).Inc()
+		inFlight := jobsInFlight.WithLabelValues(stage)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		fields := log.Fields{"stage": stage}
+		if sc := span.SpanContext(); sc.HasTraceID() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+		for k, v := range map[string]string{
+			"correlation_id":    msg.CorrelationID(),
+			"origin_message_id": msg.originMessageID(),
+			"message_id":        msg.Header["message-id"],
+			"upstream_stage":    msg.Header[HeaderStage],
+			"origin_ts":         msg.originTimestamp(),
+		} {
+			if v != "" {
+				fields[k] = v
+			}
+		}
+		err := proc(WithLogFields(ctx, fields), msg)
+		recordError(span, err)
+		if err != nil || msg.failed {
+			jobsFailed.WithLabelValues(stage).Inc()
+		} else {
+			jobsSucceeded.WithLabelValues(stage).Inc()
+		}
+		return err
+	}
+}
+
+// WithLogFields returns a context whose Log entry has the extra fields.
+func WithLogFields(ctx context.Context, fields log.Fields) context.Context {
+	return context.WithValue(ctx, logEntryKey, Log(ctx).WithFields(fields))
+}
+
+// Log returns the log entry attached to ctx, or a plain one.
+func Log(ctx context.Context) *log.Entry {
+	if e, ok := ctx.Value(logEntryKey).(*log.Entry); ok {
+		return e
+	}
+	return log.NewEntry(log.StandardLogger())
+}
@@ -0,0 +1,241 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type memState int
+
+const (
+	memQueued memState = iota
+	memInFlight
+	memDone
+)
+
+type memEntry struct {
+	dest       string
+	msg        Message
+	deliveries int
+	state      memState
+}
+
+// MemTransport is an in-process Transport for tests and single-box
+// deployments. Unacknowledged messages are redelivered once their handler
+// returns, and the delivery count is reported in the JMSXDeliveryCount header.
+type MemTransport struct {
+	// ErrorDelay pauses a worker after its handler fails.
+	ErrorDelay time.Duration
+	// DrainTimeout bounds how long handlers in flight may run after Run's
+	// context is cancelled.
+	DrainTimeout time.Duration
+	// Compression is applied to bodies of sent messages.
+	Compression Compression
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[string][]*memEntry
+	subs   []subscription
+	lastID int64
+}
+
+var _ Transport = (*MemTransport)(nil)
+
+var errAlreadyAcked = errors.New("message is already acknowledged")
+
+func NewMemTransport() *MemTransport {
+	t := &MemTransport{
+		ErrorDelay:   time.Second,
+		DrainTimeout: 30 * time.Second,
+		queues:       make(map[string][]*memEntry),
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+func (t *MemTransport) Subscribe(queue string, workers int, proc Handler) {
+	t.subs = append(t.subs, subscription{queue: queue, workers: workers, proc: proc})
+}
+
+func (t *MemTransport) Run(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		t.cond.Broadcast()
+		t.mu.Unlock()
+	})
+	defer stop()
+
+	hctx, cancel := drainContext(ctx, t.DrainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, v := range t.subs {
+		workers := v.workers
+		if workers < 1 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(v subscription) {
+				defer wg.Done()
+				t.processLoop(ctx, hctx, v)
+			}(v)
+		}
+	}
+	wg.Wait()
+
+	t.mu.Lock()
+	for queue, q := range t.queues {
+		if len(q) > 0 {
+			log.Warnf("dropping %d undelivered message(s) from %s", len(q), queue)
+		}
+	}
+	t.mu.Unlock()
+	return ctx.Err()
+}
+
+func (t *MemTransport) processLoop(ctx, hctx context.Context, sub subscription) {
+	for {
+		e := t.next(ctx, sub.queue)
+		if e == nil {
+			return
+		}
+
+		msg := e.msg
+		msg.Header = make(map[string]string, len(e.msg.Header)+2)
+		for k, v := range e.msg.Header {
+			msg.Header[k] = v
+		}
+		msg.Header["JMSXDeliveryCount"] = strconv.Itoa(e.deliveries)
+		if e.deliveries > 1 {
+			msg.Header["redelivered"] = "true"
+		}
+		msg.transport, msg.raw = t, e
+		t.Compression.decode(&msg)
+
+		err := sub.proc(hctx, &msg)
+		t.mu.Lock()
+		if e.state == memInFlight {
+			t.enqueueLocked(e)
+		}
+		t.mu.Unlock()
+
+		if err != nil {
+			log.Errorf("process error on %s: %v", sub.queue, err)
+			select {
+			case <-time.After(t.ErrorDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (t *MemTransport) next(ctx context.Context, queue string) *memEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if q := t.queues[queue]; len(q) > 0 {
+			e := q[0]
+			t.queues[queue] = q[1:]
+			e.state = memInFlight
+			e.deliveries++
+			return e
+		}
+		t.cond.Wait()
+	}
+}
+
+func (t *MemTransport) enqueueLocked(e *memEntry) {
+	e.state = memQueued
+	t.queues[e.dest] = append(t.queues[e.dest], e)
+	t.cond.Broadcast()
+}
+
+func (t *MemTransport) publishLocked(dest string, msg *Message) error {
+	msg, err := t.Compression.encode(dest, msg)
+	if err != nil {
+		return err
+	}
+	t.lastID++
+	header := map[string]string{
+		"message-id": "mem-" + strconv.FormatInt(t.lastID, 10),
+		"timestamp":  strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+	e := &memEntry{
+		dest: dest,
+		msg: Message{
+			Destination: dest,
+			ContentType: msg.ContentType,
+			Header:      header,
+			Body:        msg.Body,
+		},
+	}
+	t.enqueueLocked(e)
+	return nil
+}
+
+func (t *MemTransport) Publish(dest string, msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.publishLocked(dest, msg)
+}
+
+// Len returns the number of messages waiting in the queue.
+func (t *MemTransport) Len(queue string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queues[queue])
+}
+
+func (t *MemTransport) settleLocked(msg *Message, requeue bool) error {
+	e, ok := msg.raw.(*memEntry)
+	if !ok {
+		return nil
+	}
+	if e.state != memInFlight {
+		return errAlreadyAcked
+	}
+	if requeue {
+		t.enqueueLocked(e)
+	} else {
+		e.state = memDone
+	}
+	return nil
+}
+
+func (t *MemTransport) Ack(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.settleLocked(msg, false)
+}
+
+func (t *MemTransport) Nack(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.settleLocked(msg, true)
+}
+
+func (t *MemTransport) SendAndAck(msg *Message, dest string, out *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out, err := t.Compression.encode(dest, out)
+	if err != nil {
+		return err
+	}
+	if err := t.settleLocked(msg, false); err != nil {
+		return err
+	}
+	return t.publishLocked(dest, out)
+}
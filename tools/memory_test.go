@@ -0,0 +1,419 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+// runMem runs t until the test ends.
+func runMem(tb testing.TB, t *MemTransport) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		t.Run(ctx)
+		close(done)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// collect acknowledges and returns the messages delivered from queue.
+func collect(t *MemTransport, queue string) <-chan *Message {
+	ch := make(chan *Message, 16)
+	t.Subscribe(queue, 1, func(ctx context.Context, msg *Message) error {
+		ch <- msg
+		return MaybeAck(msg)
+	})
+	return ch
+}
+
+func receive(t *testing.T, ch <-chan *Message) *Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+		return nil
+	}
+}
+
+func newTestMemTransport() *MemTransport {
+	t := NewMemTransport()
+	t.ErrorDelay = time.Millisecond
+	t.DrainTimeout = time.Second
+	return t
+}
+
+func TestMemTransportRedelivery(t *testing.T) {
+	tr := newTestMemTransport()
+	counts := make(chan [2]string, 4)
+	tr.Subscribe("jobs", 1, func(ctx context.Context, msg *Message) error {
+		counts <- [2]string{msg.Header["JMSXDeliveryCount"], msg.Header["redelivered"]}
+		if msg.Header["JMSXDeliveryCount"] == "1" {
+			return errors.New("unacknowledged")
+		}
+		return MaybeAck(msg)
+	})
+	if err := tr.Publish("jobs", &Message{Body: []byte("job")}); err != nil {
+		t.Fatal(err)
+	}
+	runMem(t, tr)
+
+	for _, want := range [][2]string{{"1", ""}, {"2", "true"}} {
+		select {
+		case got := <-counts:
+			if got != want {
+				t.Errorf("delivery count and redelivered = %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not redelivered")
+		}
+	}
+	select {
+	case got := <-counts:
+		t.Errorf("acknowledged message delivered again: %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestMemTransportWorkers checks that a subscription runs as many handlers at
+// once as it has workers, and no more.
+func TestMemTransportWorkers(t *testing.T) {
+	const jobs = 8
+	for _, workers := range []int{1, 4} {
+		t.Run(strconv.Itoa(workers), func(t *testing.T) {
+			tr := newTestMemTransport()
+			var (
+				mu            sync.Mutex
+				running, peak int
+			)
+			started, release := make(chan struct{}, jobs), make(chan struct{})
+			tr.Subscribe("jobs", workers, func(ctx context.Context, msg *Message) error {
+				mu.Lock()
+				if running++; running > peak {
+					peak = running
+				}
+				mu.Unlock()
+				started <- struct{}{}
+				<-release
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return MaybeAck(msg)
+			})
+			for i := 0; i < jobs; i++ {
+				tr.Publish("jobs", &Message{Body: []byte("job")})
+			}
+			runMem(t, tr)
+
+			wait := func() {
+				select {
+				case <-started:
+				case <-time.After(5 * time.Second):
+					t.Fatal("handler not started")
+				}
+			}
+			for i := 0; i < workers; i++ {
+				wait()
+			}
+			select {
+			case <-started:
+				t.Errorf("more than %d handlers started at once", workers)
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(release)
+			for i := workers; i < jobs; i++ {
+				wait()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if peak != workers {
+				t.Errorf("%d handlers ran at once, want %d", peak, workers)
+			}
+		})
+	}
+}
+
+// drainHandlers returns a handler for fast that finishes once release is
+// closed and one for slow that runs until its context is cancelled. Both
+// report their start on started and their result on done.
+func drainHandlers(started chan<- string, release <-chan struct{}, done chan<- error) (fast, slow Handler) {
+	fast = func(ctx context.Context, msg *Message) error {
+		started <- "fast"
+		<-release
+		err := MaybeAck(msg)
+		done <- err
+		return err
+	}
+	slow = func(ctx context.Context, msg *Message) error {
+		started <- "slow"
+		<-ctx.Done()
+		done <- ctx.Err()
+		return ctx.Err()
+	}
+	return fast, slow
+}
+
+// TestMemTransportDrain checks that on shutdown handlers in flight may finish
+// within DrainTimeout, later ones are cancelled and left unacknowledged, and
+// no new messages are taken.
+func TestMemTransportDrain(t *testing.T) {
+	tr := newTestMemTransport()
+	tr.DrainTimeout = 100 * time.Millisecond
+	started, release, done := make(chan string, 4), make(chan struct{}), make(chan error, 4)
+	fast, slow := drainHandlers(started, release, done)
+	tr.Subscribe("fast", 1, fast)
+	tr.Subscribe("slow", 1, slow)
+	tr.Publish("fast", &Message{Body: []byte("1")})
+	tr.Publish("fast", &Message{Body: []byte("2")})
+	tr.Publish("slow", &Message{Body: []byte("3")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		tr.Run(ctx)
+		close(stopped)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handlers not started")
+		}
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the drain timeout")
+	}
+	close(done)
+	var results []error
+	for err := range done {
+		results = append(results, err)
+	}
+	if len(results) != 2 || results[0] != nil || results[1] != context.Canceled {
+		t.Errorf("handler results = %v, want the fast one acknowledged and the slow one cancelled", results)
+	}
+	if len(started) != 0 {
+		t.Errorf("%d handlers started after shutdown began", len(started))
+	}
+	if fast, slow := tr.Len("fast"), tr.Len("slow"); fast != 1 || slow != 1 {
+		t.Errorf("%d fast and %d slow messages left, want the untaken and the cancelled one", fast, slow)
+	}
+}
+
+func TestMemTransportSendAndAck(t *testing.T) {
+	tr := newTestMemTransport()
+	errs := make(chan error, 3)
+	tr.Subscribe("jobs", 1, func(ctx context.Context, msg *Message) error {
+		errs <- tr.SendAndAck(msg, "out", &Message{Body: []byte("first")})
+		errs <- tr.SendAndAck(msg, "out", &Message{Body: []byte("second")})
+		errs <- tr.Nack(msg)
+		return nil
+	})
+	out := collect(tr, "out")
+	tr.Publish("jobs", &Message{Body: []byte("job")})
+	runMem(t, tr)
+
+	if msg := receive(t, out); string(msg.Body) != "first" {
+		t.Errorf("sent %q, want %q", msg.Body, "first")
+	}
+	for i, want := range []error{nil, errAlreadyAcked, errAlreadyAcked} {
+		if err := <-errs; err != want {
+			t.Errorf("call %d returned %v, want %v", i, err, want)
+		}
+	}
+	select {
+	case msg := <-out:
+		t.Errorf("sent %q after the message was acknowledged", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := tr.Len("jobs"); n != 0 {
+		t.Errorf("%d messages left in jobs after SendAndAck", n)
+	}
+}
+
+func TestMemTransportDeadLetter(t *testing.T) {
+	tr := newTestMemTransport()
+	var calls int
+	retry := RetryPolicy{MaxAttempts: 3, DeadLetterQueue: "dlq", RetryDelay: time.Millisecond}
+	tr.Subscribe("jobs", 1, WithStage("test", retry.Wrap(func(ctx context.Context, msg *Message) error {
+		calls++
+		return errors.New("printer on fire")
+	})))
+	dlq := collect(tr, "dlq")
+	tr.Publish("jobs", &Message{Body: []byte("job")})
+	runMem(t, tr)
+
+	msg := receive(t, dlq)
+	if string(msg.Body) != "job" {
+		t.Errorf("dead letter body = %q", msg.Body)
+	}
+	for k, want := range map[string]string{
+		HeaderDeliveryAttempts:    "3",
+		HeaderOriginalDestination: "jobs",
+		HeaderError:               "printer on fire",
+		HeaderStage:               "test",
+	} {
+		if got := msg.Header[k]; got != want {
+			t.Errorf("dead letter header %s = %q, want %q", k, got, want)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("handler ran %d times, want 3", calls)
+	}
+	if n := tr.Len("jobs"); n != 0 {
+		t.Errorf("%d messages left in jobs", n)
+	}
+}
+
+// forward returns a handler that sends a TexJob with the received data on to
+// dest.
+func forward(dest string) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		var job tpb.TexJob
+		if err := Unmarshal(msg, &job); err != nil {
+			return err
+		}
+		return SendAndAck(msg, dest, &tpb.TexJob{JobId: job.GetJobId(), Data: job.GetData()})
+	}
+}
+
+func publishJob(t *testing.T, tr *MemTransport, dest string, job proto.Message) {
+	t.Helper()
+	body, contentType, err := marshalBody(job, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Publish(dest, &Message{ContentType: contentType, Body: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemTransportLineage(t *testing.T) {
+	tr := newTestMemTransport()
+	firstIDs := make(chan [2]string, 1)
+	tr.Subscribe("a", 1, WithStage("first", func(ctx context.Context, msg *Message) error {
+		firstIDs <- [2]string{msg.Header["message-id"], msg.Header["timestamp"]}
+		return forward("b")(ctx, msg)
+	}))
+	tr.Subscribe("b", 1, WithStage("second", forward("c")))
+	out := collect(tr, "c")
+	publishJob(t, tr, "a", &tpb.TexJob{JobId: "1"})
+	runMem(t, tr)
+
+	msg := receive(t, out)
+	ids := <-firstIDs
+	for k, want := range map[string]string{
+		HeaderCorrelationID:   ids[0],
+		HeaderOriginMessageID: ids[0],
+		HeaderOriginTimestamp: ids[1],
+		HeaderStage:           "second",
+	} {
+		if got := msg.Header[k]; got != want {
+			t.Errorf("header %s = %q, want %q", k, got, want)
+		}
+	}
+	if msg.Header[HeaderStageTimestamp] == "" {
+		t.Errorf("no %s header", HeaderStageTimestamp)
+	}
+}
+
+func TestMemTransportSigning(t *testing.T) {
+	key, err := ParseSigningKey("k1:hmac-sha256:" + base64.StdEncoding.EncodeToString(testSeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &Signing{Key: key}
+	receiver := &Signing{Accept: map[string]*SigningKey{key.ID: key}}
+	retry := RetryPolicy{DeadLetterQueue: "dlq"}
+
+	tr := newTestMemTransport()
+	tr.Compression = Compression{Default: CompressionRule{Encoding: "zstd"}}
+	tr.Subscribe("a", 1, retry.Wrap(sender.Wrap(forward("b"))))
+	tr.Subscribe("b", 1, retry.Wrap(receiver.Wrap(forward("c"))))
+	out := collect(tr, "c")
+	dlq := collect(tr, "dlq")
+	data := bytes.Repeat([]byte("compressible "), 100)
+	publishJob(t, tr, "a", &tpb.TexJob{JobId: "signed", Data: data})
+	publishJob(t, tr, "b", &tpb.TexJob{JobId: "unsigned", Data: data})
+	runMem(t, tr)
+
+	var job tpb.TexJob
+	if err := Unmarshal(receive(t, out), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.GetJobId() != "signed" || !bytes.Equal(job.GetData(), data) {
+		t.Errorf("got job %q with %d bytes, want the signed job", job.GetJobId(), len(job.GetData()))
+	}
+	msg := receive(t, dlq)
+	if err := Unmarshal(msg, &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.GetJobId() != "unsigned" || msg.Header[HeaderError] != errUnsigned.Error() {
+		t.Errorf("dead-lettered job %q with error %q, want the unsigned job", job.GetJobId(), msg.Header[HeaderError])
+	}
+}
+
+func TestMemTransportClaimCheck(t *testing.T) {
+	store, err := NewDirBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &ClaimCheck{Store: store, Threshold: 16}
+
+	tr := newTestMemTransport()
+	tr.Subscribe("a", 1, claims.Wrap(forward("b")))
+	raw, resolved := make(chan *Message, 1), make(chan *tpb.TexJob, 1)
+	tr.Subscribe("b", 1, func(ctx context.Context, msg *Message) error {
+		sent := *msg
+		raw <- &sent
+		return claims.Wrap(func(ctx context.Context, msg *Message) error {
+			var job tpb.TexJob
+			if err := Unmarshal(msg, &job); err != nil {
+				return err
+			}
+			resolved <- &job
+			return MaybeAck(msg)
+		})(ctx, msg)
+	})
+	data := []byte("a payload above the threshold")
+	publishJob(t, tr, "a", &tpb.TexJob{JobId: "1", Data: data})
+	runMem(t, tr)
+
+	var job tpb.TexJob
+	if err := Unmarshal(receive(t, raw), &job); err != nil {
+		t.Fatal(err)
+	}
+	if len(job.GetData()) != 0 || job.GetDataRef().GetSize() != int64(len(data)) {
+		t.Errorf("sent job has %d bytes of data and ref %v, want the payload offloaded", len(job.GetData()), job.GetDataRef())
+	}
+	if blob, err := store.Get(context.Background(), job.GetDataRef().GetSha256()); err != nil || !bytes.Equal(blob, data) {
+		t.Errorf("stored blob = %q, %v", blob, err)
+	}
+	select {
+	case job := <-resolved:
+		if !bytes.Equal(job.GetData(), data) || job.GetDataRef() != nil {
+			t.Errorf("resolved job has data %q and ref %v, want the payload inline", job.GetData(), job.GetDataRef())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payload was not resolved")
+	}
+}
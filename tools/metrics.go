@@ -0,0 +1,71 @@
+package tools
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	jobsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "printing",
+		Name:      "jobs_received_total",
+		Help:      "Jobs received, by stage.",
+	}, []string{"stage"})
+	jobsSucceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "printing",
+		Name:      "jobs_succeeded_total",
+		Help:      "Jobs handled successfully, by stage.",
+	}, []string{"stage"})
+	jobsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "printing",
+		Name:      "jobs_failed_total",
+		Help:      "Jobs that failed or could not be handled, by stage.",
+	}, []string{"stage"})
+	jobsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "printing",
+		Name:      "jobs_in_flight",
+		Help:      "Jobs being handled right now, by stage.",
+	}, []string{"stage"})
+	stepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "printing",
+		Name:      "step_duration_seconds",
+		Help:      "Duration of job processing steps such as latex runs or printer submission.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"step"})
+	pagesProduced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "printing",
+		Name:      "pages_total",
+		Help:      "Pages produced, by printer.",
+	}, []string{"printer"})
+)
+
+// CountPages records pages produced for the printer.
+func CountPages(printer string, pages int64) {
+	pagesProduced.WithLabelValues(printer).Add(float64(pages))
+}
+
+func observeStep(step string, start time.Time) {
+	stepDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+}
+
+// ServeMetrics exposes /metrics on addr in the background. Empty addr
+// disables it.
+func ServeMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Infof("serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("metrics server: %v", err)
+		}
+	}()
+}
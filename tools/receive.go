@@ -1,67 +1,66 @@
 package tools
 
 import (
-	"context"
+	"fmt"
 
-	"github.com/go-stomp/stomp"
 	"google.golang.org/protobuf/proto"
-
-	log "github.com/sirupsen/logrus"
 )
 
-func MaybeAck(msg *stomp.Message) error {
-	if msg.ShouldAck() {
-		return msg.Conn.Ack(msg)
+func MaybeAck(msg *Message) error {
+	if msg.transport != nil {
+		return msg.transport.Ack(msg)
 	}
 	return nil
 }
 
-func SendAndAck(msg *stomp.Message, dest string, data proto.Message) error {
-	buf, err := proto.Marshal(data)
-	if err != nil {
-		log.Errorf("error marshaling message %v: %v", data, err)
-		return MaybeAck(msg)
+type sendOptions struct {
+	json bool
+}
+
+// SendOption changes how SendAndAck encodes a message.
+type SendOption func(*sendOptions)
+
+// AsJSON makes SendAndAck encode the message as JSON rather than binary
+// protobuf if on is set, for instance for queues read by people.
+func AsJSON(on bool) SendOption {
+	return func(o *sendOptions) {
+		o.json = on
 	}
-	if msg.ShouldAck() {
-		tx := msg.Conn.Begin()
-		if err := tx.Send(dest, "application/vnd.google.protobuf", buf, stomp.SendOpt.Header("delivery-mode", "2")); err != nil {
-			log.Errorf("error sending message %v in transaction: %v", data, err)
-			return err
-		}
-		if err := tx.Ack(msg); err != nil {
-			log.Errorf("error acking message in transaction: %v", err)
-			return err
-		}
-		if err := tx.Commit(); err != nil {
-			log.Errorf("error committing transaction: %v", err)
+}
+
+func SendAndAck(msg *Message, dest string, data proto.Message, opts ...SendOption) error {
+	var so sendOptions
+	for _, v := range opts {
+		v(&so)
+	}
+	if msg.claims != nil {
+		var err error
+		if data, err = msg.claims.offload(data); err != nil {
 			return err
 		}
-		return nil
 	}
-	return msg.Conn.Send(dest, "application/vnd.google.protobuf", buf, stomp.SendOpt.Header("delivery-mode", "2"))
-}
-
-func SubscribeAndProcess(ctx context.Context, conn *stomp.Conn, queue string, proc func(context.Context, *stomp.Message) error) (*stomp.Subscription, error) {
-	sub, err := conn.Subscribe(queue, stomp.AckClient)
+	buf, contentType, err := marshalBody(data, so.json)
 	if err != nil {
-		return nil, err
+		return Permanent(fmt.Errorf("error marshaling message %v: %w", data, err))
+	}
+	out := &Message{
+		ContentType: contentType,
+		Body:        buf,
 	}
+	if msg.signing != nil {
+		msg.signing.sign(out)
+	}
+	return sendAndAck(msg, dest, out)
+}
 
-	go func() {
-		for {
-			select {
-			case v, ok := <-sub.C:
-				if !ok {
-					log.Fatalf("subscription %q closed", sub.Id())
-				}
-				if err := proc(ctx, v); err != nil {
-					log.Fatalf("process error: %v", err)
-				}
-			case <-ctx.Done():
-				sub.Unsubscribe()
-				return
-			}
-		}
-	}()
-	return sub, nil
+func sendAndAck(msg *Message, dest string, out *Message) error {
+	if msg.transport == nil {
+		return fmt.Errorf("message to %s has no transport", dest)
+	}
+	headers := lineageHeaders(msg)
+	for k, v := range out.Header {
+		headers[k] = v
+	}
+	out.Header = headers
+	return msg.transport.SendAndAck(msg, dest, out)
 }
@@ -0,0 +1,196 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// PermanentError marks a handler error that redelivery can't fix, such as a
+// message that can't be parsed.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+func IsPermanent(err error) bool {
+	var perm *PermanentError
+	return errors.As(err, &perm)
+}
+
+// Headers added to messages routed to the dead-letter queue. Messages
+// RetryPolicy sends back to their queue carry HeaderDeliveryAttempts too, so
+// strip it when replaying dead letters.
+const (
+	HeaderError               = "x-error"
+	HeaderOriginalDestination = "x-original-destination"
+	HeaderDeliveryAttempts    = "x-delivery-attempts"
+)
+
+// DeliveryAttempt returns the 1-based delivery attempt of msg: the attempts
+// RetryPolicy recorded when it sent the message back to its queue, plus the
+// deliveries of this copy as reported by the broker.
+func DeliveryAttempt(msg *Message) int {
+	previous, err := strconv.Atoi(msg.Header[HeaderDeliveryAttempts])
+	if err != nil || previous < 0 {
+		previous = 0
+	}
+	return previous + brokerDeliveries(msg)
+}
+
+// brokerDeliveries returns how many times the broker delivered msg. Without a
+// count header a redelivered message counts as the second delivery, which is
+// why RetryPolicy counts attempts itself.
+func brokerDeliveries(msg *Message) int {
+	// ActiveMQ and Artemis: JMS delivery count, 1 on first delivery.
+	if n, err := strconv.Atoi(msg.Header["JMSXDeliveryCount"]); err == nil && n > 0 {
+		return n
+	}
+	// RabbitMQ quorum queues: number of previous deliveries.
+	if n, err := strconv.Atoi(msg.Header["x-delivery-count"]); err == nil && n >= 0 {
+		return n + 1
+	}
+	if msg.Header["redelivered"] == "true" {
+		return 2
+	}
+	return 1
+}
+
+type RetryPolicy struct {
+	// MaxAttempts bounds deliveries of a message failing with transient errors.
+	// Zero means retry forever.
+	MaxAttempts int
+
+	// DeadLetterQueue receives messages failing with permanent errors and
+	// messages out of attempts. If empty, such messages are logged and dropped.
+	DeadLetterQueue string
+
+	// RetryDelay is the wait before the first retry, doubled for every further
+	// attempt up to MaxRetryDelay. They default to a second and a minute.
+	RetryDelay, MaxRetryDelay time.Duration
+
+	// DelayHeader names the header the broker schedules delivery by, such as
+	// AMQ_SCHEDULED_DELAY for ActiveMQ with schedulerSupport. If set, a retry
+	// is sent back at once with the delay in milliseconds in it. Otherwise the
+	// worker waits out the delay, but no longer than MaxRetryWait, 5 seconds
+	// by default, so that a failing job holds up its queue only briefly.
+	DelayHeader  string
+	MaxRetryWait time.Duration
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay, maxDelay := p.RetryDelay, p.MaxRetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	if maxDelay <= 0 {
+		maxDelay = time.Minute
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// brokerHeaders are set by the broker on delivery and dropped when a message
+// is sent back to its queue.
+var brokerHeaders = []string{
+	"message-id", "destination", "subscription", "ack", "redelivered",
+	"content-type", "content-length", "timestamp", "JMSXDeliveryCount", "x-delivery-count",
+}
+
+// Wrap returns a handler that retries messages failing with transient errors
+// and dead-letters the rest. A message is retried after a delay by sending it
+// back to its queue with the attempt count in HeaderDeliveryAttempts and
+// acknowledging the delivery, so the count doesn't depend on the broker.
+func (p RetryPolicy) Wrap(proc Handler) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		// The handler may replace the body, see ClaimCheck.
+		body := msg.Body
+		err := proc(ctx, msg)
+		if err == nil || ctx.Err() != nil || msg.transport == nil {
+			return err
+		}
+		msg.Body = body
+		// Retried and dead-lettered messages are acknowledged, but the job failed.
+		msg.MarkFailed()
+
+		attempt := DeliveryAttempt(msg)
+		if IsPermanent(err) || p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			Log(ctx).Errorf("giving up on message from %s after %d attempt(s): %v", msg.Destination, attempt, err)
+			return p.deadLetter(ctx, msg, err, attempt)
+		}
+
+		delay := p.delay(attempt)
+		if p.DelayHeader == "" {
+			maxWait := p.MaxRetryWait
+			if maxWait <= 0 {
+				maxWait = 5 * time.Second
+			}
+			delay = min(delay, maxWait)
+		}
+		Log(ctx).Warnf("attempt %d on %s failed, retrying in %v: %v", attempt, msg.Destination, delay, err)
+		if p.DelayHeader == "" {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				// Not acknowledged, so the broker delivers it again.
+				return ctx.Err()
+			}
+		}
+		return p.retry(msg, attempt, delay)
+	}
+}
+
+func (p RetryPolicy) retry(msg *Message, attempt int, delay time.Duration) error {
+	out := &Message{
+		ContentType: msg.ContentType,
+		Body:        msg.Body,
+		Header:      make(map[string]string, len(msg.Header)),
+	}
+	for k, v := range msg.Header {
+		out.Header[k] = v
+	}
+	for _, v := range brokerHeaders {
+		delete(out.Header, v)
+	}
+	out.Header[HeaderDeliveryAttempts] = strconv.Itoa(attempt)
+	if p.DelayHeader != "" {
+		out.Header[p.DelayHeader] = strconv.FormatInt(delay.Milliseconds(), 10)
+	}
+	return sendAndAck(msg, msg.Destination, out)
+}
+
+func (p RetryPolicy) deadLetter(ctx context.Context, msg *Message, cause error, attempt int) error {
+	if p.DeadLetterQueue == "" {
+		Log(ctx).Errorf("no dead letter queue configured, dropping message from %s with %d byte body and headers %v", msg.Destination, len(msg.Body), msg.Header)
+		return MaybeAck(msg)
+	}
+	out := &Message{
+		ContentType: msg.ContentType,
+		Body:        msg.Body,
+		Header: map[string]string{
+			HeaderError:               cause.Error(),
+			HeaderOriginalDestination: msg.Destination,
+			HeaderDeliveryAttempts:    strconv.Itoa(attempt),
+		},
+	}
+	// The body is kept as it came: still encoded if it couldn't be decoded,
+	// and signed, so a replayed dead letter passes verification.
+	for _, k := range []string{HeaderContentEncoding, HeaderSignature, HeaderSignatureKeyID} {
+		if v := msg.Header[k]; v != "" {
+			out.Header[k] = v
+		}
+	}
+	return sendAndAck(msg, p.DeadLetterQueue, out)
+}
@@ -0,0 +1,312 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type sentMessage struct {
+	dest string
+	msg  *Message
+}
+
+// recordingTransport acts like a broker that reports no delivery counts.
+type recordingTransport struct {
+	sent   []sentMessage
+	acked  int
+	nacked int
+}
+
+func (t *recordingTransport) Subscribe(string, int, Handler) {}
+func (t *recordingTransport) Run(context.Context) error      { return nil }
+
+func (t *recordingTransport) Publish(dest string, msg *Message) error {
+	t.sent = append(t.sent, sentMessage{dest, msg})
+	return nil
+}
+
+func (t *recordingTransport) Ack(*Message) error {
+	t.acked++
+	return nil
+}
+
+func (t *recordingTransport) Nack(*Message) error {
+	t.nacked++
+	return nil
+}
+
+func (t *recordingTransport) SendAndAck(msg *Message, dest string, out *Message) error {
+	t.acked++
+	return t.Publish(dest, out)
+}
+
+// deliver turns a sent message into a delivery, as the broker would.
+func (t *recordingTransport) deliver(dest string, sent *Message, header map[string]string) *Message {
+	msg := &Message{
+		Destination: dest,
+		ContentType: sent.ContentType,
+		Body:        sent.Body,
+		Header:      map[string]string{"message-id": "id-" + strconv.Itoa(len(t.sent)), "destination": dest},
+		transport:   t,
+	}
+	for k, v := range sent.Header {
+		msg.Header[k] = v
+	}
+	for k, v := range header {
+		msg.Header[k] = v
+	}
+	return msg
+}
+
+func TestDeliveryAttempt(t *testing.T) {
+	tests := []struct {
+		header map[string]string
+		want   int
+	}{
+		{nil, 1},
+		{map[string]string{"redelivered": "true"}, 2},
+		{map[string]string{"JMSXDeliveryCount": "3", "redelivered": "true"}, 3},
+		{map[string]string{"x-delivery-count": "2"}, 3},
+		{map[string]string{"JMSXDeliveryCount": "junk"}, 1},
+		{map[string]string{HeaderDeliveryAttempts: "2"}, 3},
+		{map[string]string{HeaderDeliveryAttempts: "2", "JMSXDeliveryCount": "2"}, 4},
+		{map[string]string{HeaderDeliveryAttempts: "2", "redelivered": "true"}, 4},
+		{map[string]string{HeaderDeliveryAttempts: "-5"}, 1},
+	}
+	for _, tt := range tests {
+		if got := DeliveryAttempt(&Message{Header: tt.header}); got != tt.want {
+			t.Errorf("DeliveryAttempt(%v) = %d, want %d", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second}
+	for attempt, want := range []time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if want == 0 {
+			continue
+		}
+		if got := p.delay(attempt); got != want {
+			t.Errorf("delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+	if got := (RetryPolicy{}).delay(100); got != time.Minute {
+		t.Errorf("default delay(100) = %v, want 1m", got)
+	}
+}
+
+// TestRetryWithoutDeliveryCount checks that messages reach the dead-letter
+// queue even if the broker reports no delivery count.
+func TestRetryWithoutDeliveryCount(t *testing.T) {
+	tr := &recordingTransport{}
+	errFailed := errors.New("printer on fire")
+	var calls int
+	proc := RetryPolicy{MaxAttempts: 3, DeadLetterQueue: "dlq", RetryDelay: time.Millisecond}.Wrap(
+		func(ctx context.Context, msg *Message) error {
+			calls++
+			// Like ClaimCheck, replace the body.
+			msg.Body = []byte("resolved")
+			return errFailed
+		})
+
+	msg := tr.deliver("jobs", &Message{
+		ContentType: "application/x-protobuf",
+		Body:        []byte("original"),
+		Header:      map[string]string{HeaderSignature: "sig"},
+	}, nil)
+	for i := 0; ; i++ {
+		if i > 10 {
+			t.Fatal("message was never dead-lettered")
+		}
+		if err := proc(context.Background(), msg); err != nil {
+			t.Fatalf("handler returned %v", err)
+		}
+		last := tr.sent[len(tr.sent)-1]
+		if last.dest == "dlq" {
+			break
+		}
+		if last.dest != "jobs" {
+			t.Fatalf("retry sent to %q, want the original queue", last.dest)
+		}
+		if string(last.msg.Body) != "original" {
+			t.Errorf("retry body = %q, want the body as received", last.msg.Body)
+		}
+		if last.msg.Header[HeaderSignature] != "sig" {
+			t.Errorf("retry lost the signature header: %v", last.msg.Header)
+		}
+		for _, v := range []string{"message-id", "destination"} {
+			if _, ok := last.msg.Header[v]; ok {
+				t.Errorf("retry kept broker header %q", v)
+			}
+		}
+		// A broker without delivery counts.
+		msg = tr.deliver("jobs", last.msg, nil)
+	}
+
+	if calls != 3 {
+		t.Errorf("handler ran %d times, want 3", calls)
+	}
+	if tr.acked != 3 || tr.nacked != 0 {
+		t.Errorf("acked %d and nacked %d times, want 3 and 0", tr.acked, tr.nacked)
+	}
+	dead := tr.sent[len(tr.sent)-1].msg
+	if dead.Header[HeaderDeliveryAttempts] != "3" || dead.Header[HeaderOriginalDestination] != "jobs" || dead.Header[HeaderError] != errFailed.Error() {
+		t.Errorf("dead letter headers = %v", dead.Header)
+	}
+	if string(dead.Body) != "original" {
+		t.Errorf("dead letter body = %q, want the body as received", dead.Body)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	tr := &recordingTransport{}
+	proc := RetryPolicy{MaxAttempts: 5, DeadLetterQueue: "dlq"}.Wrap(func(context.Context, *Message) error {
+		return Permanent(errors.New("malformed"))
+	})
+	if err := proc(context.Background(), tr.deliver("jobs", &Message{}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.sent) != 1 || tr.sent[0].dest != "dlq" || tr.sent[0].msg.Header[HeaderDeliveryAttempts] != "1" {
+		t.Errorf("sent %+v, want one dead letter after 1 attempt", tr.sent)
+	}
+}
+
+func TestRetryShutdown(t *testing.T) {
+	tr := &recordingTransport{}
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := RetryPolicy{RetryDelay: time.Hour}.Wrap(func(context.Context, *Message) error {
+		cancel()
+		return errors.New("interrupted")
+	})
+	if err := proc(ctx, tr.deliver("jobs", &Message{}, nil)); err == nil {
+		t.Error("handler returned nil, want the error so the delivery is left unacknowledged")
+	}
+	if len(tr.sent) != 0 || tr.acked != 0 {
+		t.Errorf("sent %d and acked %d messages during shutdown", len(tr.sent), tr.acked)
+	}
+}
+
+// TestRetryDelayHeader checks that a broker scheduling deliveries is left to
+// wait out the delay instead of the worker.
+func TestRetryDelayHeader(t *testing.T) {
+	tr := &recordingTransport{}
+	p := RetryPolicy{RetryDelay: time.Hour, MaxRetryDelay: 2 * time.Hour, DelayHeader: "AMQ_SCHEDULED_DELAY"}
+	proc := p.Wrap(func(context.Context, *Message) error { return errors.New("busy") })
+
+	start := time.Now()
+	msg := tr.deliver("jobs", &Message{Body: []byte("job")}, nil)
+	for _, want := range []string{"3600000", "7200000"} {
+		if err := proc(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+		retry := tr.sent[len(tr.sent)-1].msg
+		if got := retry.Header["AMQ_SCHEDULED_DELAY"]; got != want {
+			t.Errorf("retry delay header = %q, want %q", got, want)
+		}
+		msg = tr.deliver("jobs", retry, nil)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handler waited %v", elapsed)
+	}
+}
+
+func TestRetryMaxWait(t *testing.T) {
+	tr := &recordingTransport{}
+	proc := RetryPolicy{RetryDelay: time.Hour, MaxRetryWait: 10 * time.Millisecond}.Wrap(func(context.Context, *Message) error {
+		return errors.New("busy")
+	})
+	start := time.Now()
+	if err := proc(context.Background(), tr.deliver("jobs", &Message{}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > time.Second {
+		t.Errorf("handler waited %v, want about 10ms", elapsed)
+	}
+	if len(tr.sent) != 1 || tr.sent[0].dest != "jobs" || tr.sent[0].msg.Header["AMQ_SCHEDULED_DELAY"] != "" {
+		t.Errorf("sent %+v, want a retry without a delay header", tr.sent)
+	}
+}
+
+// TestDropWithoutDeadLetterQueue checks that a dropped message is logged
+// without its body.
+func TestDropWithoutDeadLetterQueue(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tr := &recordingTransport{}
+	proc := RetryPolicy{}.Wrap(func(context.Context, *Message) error { return Permanent(errors.New("malformed")) })
+	if err := proc(context.Background(), tr.deliver("jobs", &Message{Body: []byte("secret job body")}, map[string]string{"x-job": "1"})); err != nil {
+		t.Fatal(err)
+	}
+	if tr.acked != 1 || len(tr.sent) != 0 {
+		t.Errorf("acked %d and sent %d messages, want the message dropped", tr.acked, len(tr.sent))
+	}
+	if logged := out.String(); strings.Contains(logged, "secret") || !strings.Contains(logged, "15 byte body") || !strings.Contains(logged, "x-job:1") {
+		t.Errorf("logged %q, want the size and headers of the message but not its body", logged)
+	}
+}
+
+// counted returns the value of the counter name for stage.
+func counted(t *testing.T, name, stage string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "stage" && l.GetValue() == stage {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// TestRetryMetrics checks how the stage metrics count messages that are
+// handled, retried and dead-lettered.
+func TestRetryMetrics(t *testing.T) {
+	for _, tt := range []struct {
+		stage             string
+		err               error
+		maxAttempts       int
+		succeeded, failed float64
+	}{
+		{"metrics-ok", nil, 0, 1, 0},
+		{"metrics-retry", errors.New("busy"), 0, 0, 1},
+		{"metrics-out-of-attempts", errors.New("busy"), 1, 0, 1},
+		{"metrics-permanent", Permanent(errors.New("malformed")), 0, 0, 1},
+	} {
+		tr := &recordingTransport{}
+		policy := RetryPolicy{MaxAttempts: tt.maxAttempts, DeadLetterQueue: "dlq", MaxRetryWait: time.Millisecond}
+		proc := WithStage(tt.stage, policy.Wrap(func(ctx context.Context, msg *Message) error {
+			if tt.err != nil {
+				return tt.err
+			}
+			return MaybeAck(msg)
+		}))
+		if err := proc(context.Background(), tr.deliver("jobs", &Message{}, nil)); err != nil {
+			t.Fatal(err)
+		}
+		succeeded := counted(t, "printing_jobs_succeeded_total", tt.stage)
+		failed := counted(t, "printing_jobs_failed_total", tt.stage)
+		if succeeded != tt.succeeded || failed != tt.failed || tr.acked != 1 {
+			t.Errorf("%s: counted %v succeeded and %v failed, acked %d, want %v, %v and 1", tt.stage, succeeded, failed, tr.acked, tt.succeeded, tt.failed)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Headers carrying the signature of a message sent with SendAndAck.
+const (
+	HeaderSignature      = "x-signature"
+	HeaderSignatureKeyID = "x-signature-key-id"
+)
+
+// MinHMACSecret is the shortest HMAC secret ParseSigningKey accepts, the size
+// of the SHA-256 output.
+const MinHMACSecret = 32
+
+var errUnsigned = errors.New("message is not signed")
+
+// SigningKey is a named HMAC-SHA256 secret or Ed25519 key. An Ed25519 key
+// parsed from a public key can only verify.
+type SigningKey struct {
+	ID string
+
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// ParseSigningKey parses a key of the form id:algorithm:base64, where the
+// algorithm is one of
+//
+//	hmac-sha256     shared secret of at least MinHMACSecret bytes
+//	ed25519         32-byte seed or 64-byte private key
+//	ed25519-public  32-byte public key, for verification only
+func ParseSigningKey(spec string) (*SigningKey, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("signing key must be id:algorithm:base64")
+	}
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signing key %q: %w", parts[0], err)
+	}
+
+	result := &SigningKey{ID: parts[0]}
+	switch parts[1] {
+	case "hmac-sha256":
+		if len(material) < MinHMACSecret {
+			return nil, fmt.Errorf("signing key %q: hmac secret is %d bytes, need at least %d", parts[0], len(material), MinHMACSecret)
+		}
+		result.secret = material
+	case "ed25519":
+		switch len(material) {
+		case ed25519.SeedSize:
+			result.private = ed25519.NewKeyFromSeed(material)
+		case ed25519.PrivateKeySize:
+			result.private = ed25519.PrivateKey(material)
+		default:
+			return nil, fmt.Errorf("signing key %q: bad ed25519 private key size %d", parts[0], len(material))
+		}
+		result.public = result.private.Public().(ed25519.PublicKey)
+	case "ed25519-public":
+		if len(material) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("signing key %q: bad ed25519 public key size %d", parts[0], len(material))
+		}
+		result.public = ed25519.PublicKey(material)
+	default:
+		return nil, fmt.Errorf("signing key %q: unknown algorithm %q", parts[0], parts[1])
+	}
+	return result, nil
+}
+
+func (k *SigningKey) canSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *SigningKey) sign(data []byte) []byte {
+	if k.secret != nil {
+		h := hmac.New(sha256.New, k.secret)
+		h.Write(data)
+		return h.Sum(nil)
+	}
+	return ed25519.Sign(k.private, data)
+}
+
+func (k *SigningKey) verify(data, sig []byte) bool {
+	if k.secret != nil {
+		return hmac.Equal(k.sign(data), sig)
+	}
+	return ed25519.Verify(k.public, data, sig)
+}
+
+// signedData is what a signature covers: the content type, which names the
+// message type, and the body as produced before compression.
+func signedData(msg *Message) []byte {
+	return append([]byte("printing3-v1\n"+msg.ContentType+"\n"), msg.Body...)
+}
+
+// Signing signs messages a stage sends with SendAndAck and checks the
+// signatures of messages it receives.
+type Signing struct {
+	// Key signs sent messages. If nil, they are sent unsigned.
+	Key *SigningKey
+	// Accept holds the keys received messages may be signed with. Several
+	// keys allow rotating them during a contest. If empty, received messages
+	// are not checked.
+	Accept map[string]*SigningKey
+}
+
+// NewSigning parses the signing key and the accepted keys of a stage, see
+// ParseSigningKey. Either may be empty.
+func NewSigning(key string, accept []string) (*Signing, error) {
+	result := &Signing{Accept: make(map[string]*SigningKey, len(accept))}
+	if key != "" {
+		k, err := ParseSigningKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if !k.canSign() {
+			return nil, fmt.Errorf("signing key %q can only verify", k.ID)
+		}
+		result.Key = k
+	}
+	for _, v := range accept {
+		k, err := ParseSigningKey(v)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := result.Accept[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate signing key %q", k.ID)
+		}
+		result.Accept[k.ID] = k
+	}
+	return result, nil
+}
+
+func (s *Signing) sign(msg *Message) {
+	if s.Key == nil {
+		return
+	}
+	if msg.Header == nil {
+		msg.Header = make(map[string]string, 2)
+	}
+	msg.Header[HeaderSignatureKeyID] = s.Key.ID
+	msg.Header[HeaderSignature] = base64.StdEncoding.EncodeToString(s.Key.sign(signedData(msg)))
+}
+
+func (s *Signing) verify(msg *Message) error {
+	keyID, sig := msg.Header[HeaderSignatureKeyID], msg.Header[HeaderSignature]
+	if keyID == "" || sig == "" {
+		return errUnsigned
+	}
+	key, ok := s.Accept[keyID]
+	if !ok {
+		return fmt.Errorf("message is signed with unknown key %q", keyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !key.verify(signedData(msg), raw) {
+		return fmt.Errorf("bad signature for key %q", keyID)
+	}
+	return nil
+}
+
+// Wrap returns a handler that rejects messages not signed with an accepted key
+// as permanent failures, so RetryPolicy dead-letters them, and signs messages
+// proc sends. It has to see the body as it was signed, so it goes outside
+// ClaimCheck.Wrap.
+func (s *Signing) Wrap(proc Handler) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		msg.signing = s
+		if len(s.Accept) > 0 {
+			if err := s.verify(msg); err != nil {
+				return Permanent(err)
+			}
+		}
+		return proc(ctx, msg)
+	}
+}
@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	tpb "github.com/contester/printing3/tickets"
+)
+
+var (
+	testSeed     = []byte("0123456789abcdef0123456789abcdef")
+	testEd25519  = "ed:ed25519:" + base64.StdEncoding.EncodeToString(testSeed)
+	testEdPublic = "ed:ed25519-public:" + base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(testSeed).Public().(ed25519.PublicKey))
+	testHMAC     = "mac:hmac-sha256:" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+)
+
+func TestParseSigningKey(t *testing.T) {
+	for _, tt := range []struct {
+		spec    string
+		canSign bool
+	}{
+		{testHMAC, true},
+		{testEd25519, true},
+		{"ed:ed25519:" + base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(testSeed)), true},
+		{testEdPublic, false},
+	} {
+		k, err := ParseSigningKey(tt.spec)
+		if err != nil {
+			t.Errorf("ParseSigningKey(%q): %v", tt.spec, err)
+			continue
+		}
+		if k.ID != strings.SplitN(tt.spec, ":", 2)[0] || k.canSign() != tt.canSign {
+			t.Errorf("ParseSigningKey(%q) = id %q, can sign %v", tt.spec, k.ID, k.canSign())
+		}
+	}
+
+	for _, v := range []string{
+		"",
+		"mac:hmac-sha256",
+		":hmac-sha256:c2VjcmV0",
+		"mac:hmac-sha256:not base64",
+		"mac:hmac-sha256:",
+		"mac:hmac-sha256:c2VjcmV0",
+		"mac:hmac-sha256:" + base64.StdEncoding.EncodeToString(testSeed[:MinHMACSecret-1]),
+		"ed:ed25519:" + base64.StdEncoding.EncodeToString(testSeed[:31]),
+		"ed:ed25519-public:" + base64.StdEncoding.EncodeToString(testSeed[:16]),
+		"rsa:rsa-sha256:c2VjcmV0",
+	} {
+		if _, err := ParseSigningKey(v); err == nil {
+			t.Errorf("ParseSigningKey(%q) succeeded", v)
+		}
+	}
+}
+
+func TestNewSigning(t *testing.T) {
+	if _, err := NewSigning(testEdPublic, nil); err == nil {
+		t.Error("NewSigning accepted a public key as the signing key")
+	}
+	if _, err := NewSigning("", []string{testHMAC, testHMAC}); err == nil {
+		t.Error("NewSigning accepted duplicate key ids")
+	}
+	if _, err := NewSigning("", []string{"broken"}); err == nil {
+		t.Error("NewSigning accepted a malformed verify key")
+	}
+	s, err := NewSigning(testEd25519, []string{testEdPublic, testHMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Key.ID != "ed" || len(s.Accept) != 2 {
+		t.Errorf("NewSigning = key %q, accepting %d keys", s.Key.ID, len(s.Accept))
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, pair := range [][2]string{{testHMAC, testHMAC}, {testEd25519, testEdPublic}, {testEd25519, testEd25519}} {
+		sender, err := NewSigning(pair[0], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, err := NewSigning("", []string{pair[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := func() *Message {
+			msg := &Message{ContentType: ContentTypeProtobuf + "; proto=tickets.TexJob", Body: []byte("job body")}
+			sender.sign(msg)
+			return msg
+		}
+
+		if err := receiver.verify(signed()); err != nil {
+			t.Errorf("%s: verify: %v", pair[0], err)
+		}
+		for name, tamper := range map[string]func(*Message){
+			"flipped body byte":    func(m *Message) { m.Body[0] ^= 1 },
+			"appended body":        func(m *Message) { m.Body = append(m.Body, 0) },
+			"changed content type": func(m *Message) { m.ContentType = ContentTypeProtobuf + "; proto=tickets.BinaryJob" },
+			"unknown key id":       func(m *Message) { m.Header[HeaderSignatureKeyID] = "other" },
+			"garbled signature":    func(m *Message) { m.Header[HeaderSignature] = "%%%" },
+			"truncated signature":  func(m *Message) { m.Header[HeaderSignature] = m.Header[HeaderSignature][:8] },
+			"unsigned":             func(m *Message) { delete(m.Header, HeaderSignature) },
+		} {
+			msg := signed()
+			tamper(msg)
+			if err := receiver.verify(msg); err == nil {
+				t.Errorf("%s: %s: verify succeeded", pair[0], name)
+			}
+		}
+	}
+}
+
+func TestSigningWrap(t *testing.T) {
+	key, err := ParseSigningKey(testHMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Signing{Key: key, Accept: map[string]*SigningKey{key.ID: key}}
+	tr := &recordingTransport{}
+
+	var calls int
+	proc := s.Wrap(func(ctx context.Context, msg *Message) error {
+		calls++
+		return SendAndAck(msg, "out", &tpb.TexJob{JobId: "1"})
+	})
+	if err := proc(context.Background(), tr.deliver("in", &Message{Body: []byte("job")}, nil)); !IsPermanent(err) || !errors.Is(err, errUnsigned) {
+		t.Errorf("unsigned message: got %v, want a permanent error", err)
+	}
+	if calls != 0 {
+		t.Error("handler called for an unsigned message")
+	}
+
+	in := &Message{Body: []byte("job")}
+	s.sign(in)
+	if err := proc(context.Background(), tr.deliver("in", in, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || len(tr.sent) != 1 {
+		t.Fatalf("handler called %d times and sent %d messages", calls, len(tr.sent))
+	}
+	if err := s.verify(tr.sent[0].msg); err != nil {
+		t.Errorf("sent message fails verification: %v", err)
+	}
+
+	// Without accepted keys nothing is checked.
+	open := (&Signing{}).Wrap(func(context.Context, *Message) error { return nil })
+	if err := open(context.Background(), tr.deliver("in", &Message{}, nil)); err != nil {
+		t.Errorf("unchecked stage rejected an unsigned message: %v", err)
+	}
+}
+
+// TestSignedDeadLetter checks that a dead-lettered message keeps its signature,
+// so it can be replayed.
+func TestSignedDeadLetter(t *testing.T) {
+	key, err := ParseSigningKey(testEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Signing{Accept: map[string]*SigningKey{key.ID: key}}
+	tr := &recordingTransport{}
+	fail := true
+	proc := RetryPolicy{DeadLetterQueue: "dlq"}.Wrap(s.Wrap(func(ctx context.Context, msg *Message) error {
+		if fail {
+			return Permanent(errors.New("printer missing"))
+		}
+		return MaybeAck(msg)
+	}))
+
+	in := &Message{ContentType: ContentTypeProtobuf, Body: []byte("job")}
+	(&Signing{Key: key}).sign(in)
+	if err := proc(context.Background(), tr.deliver("jobs", in, nil)); err != nil {
+		t.Fatal(err)
+	}
+	dead := tr.sent[0].msg
+	if dead.Header[HeaderSignature] != in.Header[HeaderSignature] || dead.Header[HeaderSignatureKeyID] != "ed" {
+		t.Errorf("dead letter headers = %v, want the signature", dead.Header)
+	}
+
+	fail = false
+	if err := proc(context.Background(), tr.deliver("jobs", dead, nil)); err != nil {
+		t.Errorf("replayed dead letter: %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ConnState int32
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting
+	StateConnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+var errNotConnected = errors.New("stomp transport is not connected")
+
+// StompTransport keeps a STOMP connection and its subscriptions alive: when
+// the connection drops or a handler fails, it redials with exponential backoff
+// and subscribes again.
+type StompTransport struct {
+	cfg StompConfig
+
+	MinBackoff, MaxBackoff time.Duration
+
+	// DrainTimeout bounds how long handlers in flight may run after Run's
+	// context is cancelled; then their context is cancelled too.
+	DrainTimeout time.Duration
+
+	// OnStateChange, if set, is called on every connection state transition.
+	OnStateChange func(ConnState)
+
+	// Compression is applied to bodies of sent messages.
+	Compression Compression
+
+	state    ConnState
+	endpoint atomic.Value
+	subs     []subscription
+
+	mu   sync.Mutex
+	conn *stomp.Conn
+}
+
+var _ Transport = (*StompTransport)(nil)
+
+func NewStompTransport(cfg StompConfig) *StompTransport {
+	return &StompTransport{
+		cfg:        cfg,
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+
+		DrainTimeout: 30 * time.Second,
+	}
+}
+
+func (s *StompTransport) Subscribe(queue string, workers int, proc Handler) {
+	s.subs = append(s.subs, subscription{queue: queue, workers: workers, proc: proc})
+}
+
+func (s *StompTransport) State() ConnState {
+	return ConnState(atomic.LoadInt32((*int32)(&s.state)))
+}
+
+// Endpoint returns the broker address of the current connection, or an empty
+// string when disconnected.
+func (s *StompTransport) Endpoint() string {
+	v, _ := s.endpoint.Load().(string)
+	return v
+}
+
+func (s *StompTransport) setState(st ConnState) {
+	if ConnState(atomic.SwapInt32((*int32)(&s.state), int32(st))) == st {
+		return
+	}
+	log.Infof("stomp connection %s", st)
+	if s.OnStateChange != nil {
+		s.OnStateChange(st)
+	}
+}
+
+// Run connects and processes messages until ctx is cancelled.
+func (s *StompTransport) Run(ctx context.Context) error {
+	backoff := s.MinBackoff
+	for {
+		connected, err := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			s.setState(StateClosed)
+			return ctx.Err()
+		}
+		s.setState(StateDisconnected)
+		if connected {
+			backoff = s.MinBackoff
+		}
+
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Errorf("stomp connection failed: %v, reconnecting in %v", err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			s.setState(StateClosed)
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+func (s *StompTransport) runOnce(ctx context.Context) (bool, error) {
+	s.setState(StateConnecting)
+	conn, endpoint, err := DialStomp(ctx, s.cfg)
+	if err != nil {
+		return false, err
+	}
+	s.endpoint.Store(endpoint)
+	s.setConn(conn)
+	defer func() {
+		s.setConn(nil)
+		s.endpoint.Store("")
+	}()
+
+	subs := make([]*stomp.Subscription, len(s.subs))
+	for i, v := range s.subs {
+		if subs[i], err = conn.Subscribe(v.queue, ackMode(v.workers), s.cfg.SubscribeOpts(v.workers)...); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = confirmSubscriptions(ctx, conn, s.cfg.ReceiptTimeout)
+	}
+	if err != nil {
+		conn.MustDisconnect()
+		return false, err
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hctx, cancelHandlers := drainContext(ctx, s.DrainTimeout)
+	defer cancelHandlers()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, len(s.subs))
+	for i, v := range s.subs {
+		wg.Add(1)
+		go func(sub *stomp.Subscription, v subscription) {
+			defer wg.Done()
+			if err := s.process(subCtx, hctx, sub, v.workers, v.proc); err != nil {
+				errc <- err
+			}
+		}(subs[i], v)
+	}
+	s.setState(StateConnected)
+
+	select {
+	case err = <-errc:
+		conn.MustDisconnect()
+		cancel()
+		cancelHandlers()
+		wg.Wait()
+	case <-ctx.Done():
+		wg.Wait()
+		conn.Disconnect()
+	}
+	return true, err
+}
+
+// confirmSubscriptions waits until the broker has handled the SUBSCRIBE frames
+// sent so far. A broker handles frames in order, so the receipt for an empty
+// transaction sent after them will do; go-stomp takes a receipt for the
+// SUBSCRIBE itself as the end of the subscription. go-stomp may wait for a
+// receipt forever once the connection is gone, hence the timeout, which is
+// go-stomp's default receipt timeout if zero.
+func confirmSubscriptions(ctx context.Context, conn *stomp.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = stomp.DefaultRcvReceiptTimeout
+	}
+	done := make(chan error, 1)
+	go func() {
+		tx, err := conn.BeginWithError()
+		if err == nil {
+			err = tx.AbortWithReceipt()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("subscriptions not confirmed: %w", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("subscriptions not confirmed in %v", timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *StompTransport) setConn(conn *stomp.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+}
+
+func (s *StompTransport) currentConn() *stomp.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// ackMode returns the ack mode for a subscription served by the given number
+// of workers. AckClient acks are cumulative, which is only correct for
+// in-order processing.
+func ackMode(workers int) stomp.AckMode {
+	if workers > 1 {
+		return stomp.AckClientIndividual
+	}
+	return stomp.AckClient
+}
+
+// process feeds messages from sub to proc from the given number of concurrent
+// workers until ctx is cancelled. Handlers run with hctx. It returns an error
+// if the subscription closes or proc fails.
+func (s *StompTransport) process(ctx, hctx context.Context, sub *stomp.Subscription, workers int, proc Handler) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	hctx, cancelHandlers := context.WithCancel(hctx)
+	defer cancelHandlers()
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errc <- s.processLoop(wctx, hctx, sub, proc)
+		}()
+	}
+
+	var result error
+	for i := 0; i < workers; i++ {
+		if err := <-errc; err != nil && result == nil {
+			result = err
+			cancel()
+			cancelHandlers()
+		}
+	}
+	if result != nil {
+		return result
+	}
+
+	// Anything delivered but not yet acked will be redelivered by the broker.
+	go sub.Unsubscribe()
+	for range sub.C {
+	}
+	return nil
+}
+
+// processLoop takes messages from sub until ctx is cancelled and runs proc on
+// them with hctx.
+func (s *StompTransport) processLoop(ctx, hctx context.Context, sub *stomp.Subscription, proc Handler) error {
+	for {
+		select {
+		case v, ok := <-sub.C:
+			if !ok {
+				return fmt.Errorf("subscription %q closed", sub.Id())
+			}
+			if v.Err != nil {
+				return fmt.Errorf("subscription %q: %w", sub.Id(), v.Err)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := proc(hctx, s.fromStomp(v)); err != nil {
+				return fmt.Errorf("process error: %w", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *StompTransport) fromStomp(m *stomp.Message) *Message {
+	result := &Message{
+		Destination: m.Destination,
+		ContentType: m.ContentType,
+		Body:        m.Body,
+		transport:   s,
+		raw:         m,
+	}
+	if m.Header != nil {
+		result.Header = make(map[string]string, m.Header.Len())
+		for i := 0; i < m.Header.Len(); i++ {
+			// Per the STOMP spec only the first occurrence of a repeated header counts.
+			if k, v := m.Header.GetAt(i); result.Header[k] == "" {
+				result.Header[k] = v
+			}
+		}
+	}
+	s.Compression.decode(result)
+	return result
+}
+
+func sendOpts(msg *Message) []func(*frame.Frame) error {
+	opts := []func(*frame.Frame) error{stomp.SendOpt.Header("delivery-mode", "2")}
+	for k, v := range msg.Header {
+		opts = append(opts, stomp.SendOpt.Header(k, v))
+	}
+	return opts
+}
+
+func (s *StompTransport) Publish(dest string, msg *Message) error {
+	conn := s.currentConn()
+	if conn == nil {
+		return errNotConnected
+	}
+	msg, err := s.Compression.encode(dest, msg)
+	if err != nil {
+		return err
+	}
+	return conn.Send(dest, msg.ContentType, msg.Body, sendOpts(msg)...)
+}
+
+func rawStomp(msg *Message) (*stomp.Message, bool) {
+	m, ok := msg.raw.(*stomp.Message)
+	return m, ok && m.ShouldAck()
+}
+
+func (s *StompTransport) Ack(msg *Message) error {
+	if m, ok := rawStomp(msg); ok {
+		return m.Conn.Ack(m)
+	}
+	return nil
+}
+
+func (s *StompTransport) Nack(msg *Message) error {
+	if m, ok := rawStomp(msg); ok {
+		return m.Conn.Nack(m)
+	}
+	return nil
+}
+
+func (s *StompTransport) SendAndAck(msg *Message, dest string, out *Message) error {
+	m, ok := rawStomp(msg)
+	if !ok {
+		return s.Publish(dest, out)
+	}
+	out, err := s.Compression.encode(dest, out)
+	if err != nil {
+		return err
+	}
+
+	tx := m.Conn.Begin()
+	if err := tx.Send(dest, out.ContentType, out.Body, sendOpts(out)...); err != nil {
+		log.Errorf("error sending message to %s in transaction: %v", dest, err)
+		return err
+	}
+	if err := tx.Ack(m); err != nil {
+		log.Errorf("error acking message in transaction: %v", err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Errorf("error committing transaction: %v", err)
+		return err
+	}
+	return nil
+}
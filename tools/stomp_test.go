@@ -0,0 +1,382 @@
+package tools
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// fakeBroker is a minimal STOMP broker serving one client at a time. It
+// answers CONNECT, sends a RECEIPT for every frame that asks for one and
+// reports each frame it reads as "COMMAND destination" on events before
+// replying to it.
+type fakeBroker struct {
+	addr   string
+	events chan string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	w      *frame.Writer
+	subs   map[string]*frame.Frame
+	lastID int
+}
+
+// newFakeBroker serves STOMP on ln. If accept is set, it is called for every
+// connection before CONNECT is read and may refuse it.
+func newFakeBroker(t *testing.T, ln net.Listener, accept func(net.Conn) bool) *fakeBroker {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+	b := &fakeBroker{
+		addr:   ln.Addr().String(),
+		events: make(chan string, 1000),
+		subs:   make(map[string]*frame.Frame),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if accept == nil || accept(conn) {
+					b.serve(conn)
+				}
+			}()
+		}
+	}()
+	return b
+}
+
+func listenTCP(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	r, w := frame.NewReader(conn), frame.NewWriter(conn)
+	if f, err := r.Read(); err != nil || f == nil || f.Command != frame.CONNECT && f.Command != frame.STOMP {
+		return
+	}
+	b.mu.Lock()
+	b.conn, b.w = conn, w
+	w.Write(frame.New(frame.CONNECTED, frame.Version, "1.2", frame.HeartBeat, "0,0"))
+	b.mu.Unlock()
+
+	for {
+		f, err := r.Read()
+		if err != nil {
+			return
+		}
+		if f == nil {
+			continue
+		}
+		event := f.Command
+		if dest := f.Header.Get(frame.Destination); dest != "" {
+			event += " " + dest
+			if f.Command == frame.SUBSCRIBE {
+				b.mu.Lock()
+				b.subs[dest] = f
+				b.mu.Unlock()
+			}
+		}
+		b.events <- event
+		if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+			b.mu.Lock()
+			w.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			b.mu.Unlock()
+		}
+	}
+}
+
+// subscription returns the last SUBSCRIBE frame for dest.
+func (b *fakeBroker) subscription(t *testing.T, dest string) *frame.Frame {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := b.subs[dest]
+	if f == nil {
+		t.Fatalf("no subscription to %s", dest)
+	}
+	return f
+}
+
+// deliver sends a message to the current subscriber of dest.
+func (b *fakeBroker) deliver(t *testing.T, dest, body string) {
+	t.Helper()
+	sub := b.subscription(t, dest)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	id := strconv.Itoa(b.lastID)
+	f := frame.New(frame.MESSAGE, frame.Destination, dest, frame.Subscription, sub.Header.Get(frame.Id), frame.MessageId, id, frame.Ack, id)
+	f.Body = []byte(body)
+	if err := b.w.Write(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drop closes the client connection.
+func (b *fakeBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn.Close()
+	b.subs = make(map[string]*frame.Frame)
+}
+
+// expect reads events and checks that they are want, in order.
+func expect(t *testing.T, events <-chan string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-events:
+			if got != w {
+				t.Fatalf("event %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event, want %q", w)
+		}
+	}
+}
+
+// expectUntil reads events up to and including last and returns the others
+// sorted.
+func expectUntil(t *testing.T, events <-chan string, last string) []string {
+	t.Helper()
+	var result []string
+	for {
+		select {
+		case got := <-events:
+			if got == last {
+				sort.Strings(result)
+				return result
+			}
+			result = append(result, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event, want %q after %q", last, result)
+		}
+	}
+}
+
+// runStomp runs tr against b until the returned function is called or the
+// test ends. The transport state changes go to the broker events as
+// "state <name>".
+func runStomp(t *testing.T, b *fakeBroker, tr *StompTransport) (stop func()) {
+	t.Helper()
+	tr.MinBackoff, tr.MaxBackoff = 10*time.Millisecond, 20*time.Millisecond
+	tr.OnStateChange = func(st ConnState) { b.events <- "state " + st.String() }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tr.Run(ctx)
+		close(done)
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func newTestStompTransport(t *testing.T, b *fakeBroker, params string) *StompTransport {
+	t.Helper()
+	cfg, err := ParseStompDSN("tcp(" + b.addr + ")/?" + params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStompTransport(cfg)
+}
+
+func TestStompReconnect(t *testing.T) {
+	b := newFakeBroker(t, listenTCP(t), nil)
+	tr := newTestStompTransport(t, b, "")
+	handled := make(chan string, 10)
+	handler := func(ctx context.Context, msg *Message) error {
+		handled <- string(msg.Body)
+		return MaybeAck(msg)
+	}
+	tr.Subscribe("/queue/a", 1, handler)
+	tr.Subscribe("/queue/b", 2, handler)
+	stop := runStomp(t, b, tr)
+
+	// Connected is only reported once the broker has taken both subscriptions.
+	connect := []string{"state connecting", "SUBSCRIBE /queue/a", "SUBSCRIBE /queue/b", "BEGIN", "ABORT", "state connected"}
+	expect(t, b.events, connect...)
+	if tr.Endpoint() != b.addr {
+		t.Errorf("endpoint = %q, want %q", tr.Endpoint(), b.addr)
+	}
+	b.deliver(t, "/queue/a", "first")
+	if got := <-handled; got != "first" {
+		t.Errorf("handled %q, want first", got)
+	}
+	expect(t, b.events, "ACK")
+
+	b.drop()
+	expect(t, b.events, "state disconnected")
+	expect(t, b.events, connect...)
+	b.deliver(t, "/queue/b", "second")
+	if got := <-handled; got != "second" {
+		t.Errorf("handled %q after reconnecting, want second", got)
+	}
+	expect(t, b.events, "ACK")
+
+	stop()
+	if got := expectUntil(t, b.events, "state closed"); len(got) != 3 || got[0] != "DISCONNECT" || got[1] != "UNSUBSCRIBE" || got[2] != "UNSUBSCRIBE" {
+		t.Errorf("events on shutdown = %q, want both subscriptions dropped and a DISCONNECT", got)
+	}
+}
+
+// TestStompSubscribeFailure checks that a broker refusing a subscription
+// never sees the transport report itself connected.
+func TestStompSubscribeFailure(t *testing.T) {
+	refused := make(chan struct{}, 10)
+	b := newFakeBroker(t, listenTCP(t), func(conn net.Conn) bool {
+		r, w := frame.NewReader(conn), frame.NewWriter(conn)
+		if _, err := r.Read(); err != nil {
+			return false
+		}
+		w.Write(frame.New(frame.CONNECTED, frame.Version, "1.2", frame.HeartBeat, "0,0"))
+		if f, err := r.Read(); err == nil && f.Command == frame.SUBSCRIBE {
+			w.Write(frame.New(frame.ERROR, frame.Message, "access denied"))
+		}
+		refused <- struct{}{}
+		return false
+	})
+	tr := newTestStompTransport(t, b, "")
+	tr.Subscribe("/queue/a", 1, func(ctx context.Context, msg *Message) error { return MaybeAck(msg) })
+	runStomp(t, b, tr)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-refused:
+		case <-time.After(5 * time.Second):
+			t.Fatal("transport didn't retry the refused subscription")
+		}
+		expect(t, b.events, "state connecting", "state disconnected")
+	}
+}
+
+func TestStompSubscribeOptions(t *testing.T) {
+	for _, tt := range []struct {
+		params        string
+		workers       int
+		ack, prefetch string
+	}{
+		{"", 1, "client", ""},
+		{"", 3, "client-individual", "3"},
+		{"prefetch=5", 1, "client", "5"},
+		{"prefetch=5", 3, "client-individual", "5"},
+	} {
+		b := newFakeBroker(t, listenTCP(t), nil)
+		tr := newTestStompTransport(t, b, tt.params)
+		tr.Subscribe("/queue/a", tt.workers, func(ctx context.Context, msg *Message) error { return MaybeAck(msg) })
+		stop := runStomp(t, b, tr)
+		expect(t, b.events, "state connecting", "SUBSCRIBE /queue/a", "BEGIN", "ABORT", "state connected")
+
+		sub := b.subscription(t, "/queue/a")
+		prefetch, _ := sub.Header.Contains("activemq.prefetchSize")
+		if ack := sub.Header.Get(frame.Ack); ack != tt.ack || prefetch != tt.prefetch {
+			t.Errorf("%d workers with %q: subscribed with ack %q, prefetch %q, want %q, %q", tt.workers, tt.params, ack, prefetch, tt.ack, tt.prefetch)
+		}
+		stop()
+	}
+}
+
+// TestStompWorkers checks that the workers of a subscription take messages
+// from the broker in parallel and ack each of them.
+func TestStompWorkers(t *testing.T) {
+	const workers = 3
+	b := newFakeBroker(t, listenTCP(t), nil)
+	tr := newTestStompTransport(t, b, "")
+	started, release := make(chan string, workers), make(chan struct{})
+	tr.Subscribe("/queue/a", workers, func(ctx context.Context, msg *Message) error {
+		started <- string(msg.Body)
+		<-release
+		return MaybeAck(msg)
+	})
+	runStomp(t, b, tr)
+	expect(t, b.events, "state connecting", "SUBSCRIBE /queue/a", "BEGIN", "ABORT", "state connected")
+
+	for i := 0; i < workers; i++ {
+		b.deliver(t, "/queue/a", strconv.Itoa(i))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < workers; i++ {
+		select {
+		case body := <-started:
+			seen[body] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d messages in flight at once", i, workers)
+		}
+	}
+	close(release)
+	expect(t, b.events, "ACK", "ACK", "ACK")
+	if len(seen) != workers {
+		t.Errorf("handled %v, want %d different messages", seen, workers)
+	}
+}
+
+// TestStompDrain checks that on shutdown a handler in flight may finish and
+// ack, one running past DrainTimeout is cancelled without an ack, and no
+// delivered message is taken after the cancel.
+func TestStompDrain(t *testing.T) {
+	b := newFakeBroker(t, listenTCP(t), nil)
+	tr := newTestStompTransport(t, b, "")
+	tr.DrainTimeout = 100 * time.Millisecond
+	started, release, done := make(chan string, 4), make(chan struct{}), make(chan error, 4)
+	fast, slow := drainHandlers(started, release, done)
+	tr.Subscribe("/queue/fast", 1, fast)
+	tr.Subscribe("/queue/slow", 1, slow)
+	stop := runStomp(t, b, tr)
+	expect(t, b.events, "state connecting", "SUBSCRIBE /queue/fast", "SUBSCRIBE /queue/slow", "BEGIN", "ABORT", "state connected")
+
+	b.deliver(t, "/queue/fast", "1")
+	b.deliver(t, "/queue/slow", "2")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handlers not started")
+		}
+	}
+	b.deliver(t, "/queue/fast", "3")
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the drain timeout")
+	}
+
+	if got := expectUntil(t, b.events, "state closed"); len(got) != 3 || got[0] != "ACK" || got[1] != "DISCONNECT" || got[2] != "UNSUBSCRIBE" {
+		t.Errorf("events on shutdown = %q, want one ACK, then the fast subscription dropped and a DISCONNECT", got)
+	}
+	close(done)
+	var results []error
+	for err := range done {
+		results = append(results, err)
+	}
+	if len(results) != 2 || results[0] != nil && results[1] != nil || results[0] != context.Canceled && results[1] != context.Canceled {
+		t.Errorf("handler results = %v, want the fast one acknowledged and the slow one cancelled", results)
+	}
+	if len(started) != 0 {
+		t.Errorf("%d handlers started after shutdown began", len(started))
+	}
+}
@@ -0,0 +1,88 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/contester/printing3")
+
+// InitTracing installs the global tracer provider for the service. Exporter
+// is "otlp" (configured by the standard OTEL_EXPORTER_OTLP_* variables),
+// "stdout", or empty to disable tracing. The returned function flushes and
+// stops the exporter.
+func InitTracing(ctx context.Context, service, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Traced runs f in a child span of ctx and records its duration as the step
+// name.
+func Traced(ctx context.Context, name string, f func(context.Context) error, attrs ...attribute.KeyValue) error {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	defer span.End()
+	defer observeStep(name, time.Now())
+	err := f(ctx)
+	recordError(span, err)
+	return err
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// startStageSpan starts the span for handling msg, continuing the trace from
+// its headers, and arranges for messages sent while handling it to carry the
+// span on.
+func startStageSpan(ctx context.Context, stage string, msg *Message) (context.Context, trace.Span) {
+	prop := otel.GetTextMapPropagator()
+	ctx = prop.Extract(ctx, propagation.MapCarrier(msg.Header))
+	ctx, span := tracer.Start(ctx, stage,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "stomp"),
+			attribute.String("messaging.destination.name", msg.Destination),
+			attribute.String("messaging.message.id", msg.Header["message-id"]),
+		))
+	msg.forward = make(map[string]string)
+	prop.Inject(ctx, propagation.MapCarrier(msg.forward))
+	return ctx, span
+}
@@ -0,0 +1,93 @@
+package tools
+
+import (
+	"context"
+	"time"
+)
+
+// MemDSN as a broker dsn selects a MemTransport, see OpenTransport.
+const MemDSN = "mem://"
+
+// Message is a message received from or sent through a Transport.
+type Message struct {
+	Destination string
+	ContentType string
+	Header      map[string]string
+	Body        []byte
+
+	// transport and raw identify the delivery for acknowledgement.
+	transport Transport
+	raw       interface{}
+	// stage is the pipeline stage handling the message, see WithStage.
+	stage string
+	// forward holds headers to copy into messages sent while handling this one.
+	forward map[string]string
+	failed  bool
+	// claims offloads payloads of messages sent while handling, see ClaimCheck.
+	claims *ClaimCheck
+	// signing signs messages sent while handling, see Signing.
+	signing *Signing
+}
+
+// MarkFailed records that the job in msg failed even though the handler
+// dealt with it, for instance by sending an error report.
+func (m *Message) MarkFailed() {
+	m.failed = true
+}
+
+type Handler func(context.Context, *Message) error
+
+// Transport is a message broker connection as seen by the pipeline stages.
+type Transport interface {
+	// Subscribe registers a handler for the queue, run by the given number of
+	// concurrent workers. It must be called before Run.
+	Subscribe(queue string, workers int, proc Handler)
+	// Run delivers messages to the subscribed handlers until ctx is cancelled.
+	// Then it stops taking new messages and waits for handlers in flight.
+	Run(ctx context.Context) error
+
+	Publish(dest string, msg *Message) error
+	Ack(msg *Message) error
+	Nack(msg *Message) error
+	// SendAndAck publishes out to dest and acknowledges msg atomically.
+	SendAndAck(msg *Message, dest string, out *Message) error
+}
+
+type subscription struct {
+	queue   string
+	workers int
+	proc    Handler
+}
+
+// drainContext returns the context for handlers: it is cancelled timeout after
+// ctx is, so in-flight jobs get a chance to finish during shutdown.
+func drainContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	hctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(timeout, cancel)
+	})
+	return hctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// OpenTransport returns a MemTransport if dsn is MemDSN and a StompTransport
+// for the broker in dsn otherwise, see ParseStompDSN. A MemTransport only
+// delivers to handlers in the same process and loses what is left in its
+// queues on exit, so it suits single-box setups running all the stages that
+// read its queues in one process.
+func OpenTransport(dsn string, drainTimeout time.Duration, compression Compression) (Transport, error) {
+	if dsn == MemDSN {
+		t := NewMemTransport()
+		t.DrainTimeout, t.Compression = drainTimeout, compression
+		return t, nil
+	}
+	cfg, err := ParseStompDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	t := NewStompTransport(cfg)
+	t.DrainTimeout, t.Compression = drainTimeout, compression
+	return t, nil
+}